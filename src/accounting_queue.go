@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	accountingRetryDelay    = 30
+	maxAccountingRetryDelay = 3600
+	accountingFlushInterval = 30 * time.Second
+)
+
+// deliverAccountingRequest sends the request or, when no accounting server
+// answers, queues it to be sent again by the daemon or acct-flush. Requests
+// of a session that still has queued requests are queued behind them, so the
+// server receives the requests of a session in order
+func deliverAccountingRequest(repository *SQLiteRepository, request *Packet) error {
+	_, err := sendOrQueueAccountingRequest(repository, request, true)
+	return err
+}
+
+// sendOrQueueAccountingRequest is deliverAccountingRequest that queues the
+// request without trying the servers when send is false. It tells whether
+// the request was queued because no accounting server answered
+func sendOrQueueAccountingRequest(repository *SQLiteRepository, request *Packet, send bool) (bool, error) {
+	sessionId, _ := request.GetString(AttrAcctSessionId)
+
+	queued, err := repository.HasQueuedAccounting(sessionId)
+	if err != nil {
+		return false, err
+	}
+
+	unanswered := false
+	if send && !queued {
+		err := sendAccountingRequest(repository, request)
+		if err == nil {
+			return false, nil
+		}
+		log.Warnf("deliverAccountingRequest: queueing request of session %s: %s", sessionId, err.Error())
+		unanswered = true
+	}
+
+	return unanswered, queueAccountingRequest(repository, request, time.Now().Unix())
+}
+
+func queueAccountingRequest(repository *SQLiteRepository, request *Packet, now int64) error {
+	// Accounting-Requests carry no password, the secret is not needed
+	packet, err := request.marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	sessionId, _ := request.GetString(AttrAcctSessionId)
+
+	return repository.QueueAccounting(QueuedAccounting{SessionId: sessionId, Packet: packet, CreatedAt: now, NextAttemptAt: now})
+}
+
+// flushAccounting sends the queued requests that are due in queue order. The
+// first failure ends the flush, as the accounting servers are not answering,
+// and postpones that request with an exponential backoff
+func flushAccounting(repository *SQLiteRepository, now int64) (int, error) {
+	entries, err := repository.QueuedAccounting()
+	if err != nil {
+		return 0, err
+	}
+
+	// A session whose request is not sent keeps its later requests queued
+	blocked := make(map[string]bool)
+	sent := 0
+
+	for _, entry := range entries {
+		if blocked[entry.SessionId] {
+			continue
+		}
+
+		claimed, err := repository.ClaimQueuedAccounting(entry.Id, now, now+int64(2*radiusDeadline().Seconds()))
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			blocked[entry.SessionId] = true
+			continue
+		}
+
+		request, err := queuedAccountingRequest(entry, now)
+		if err != nil {
+			log.Errorf("flushAccounting: dropping malformed request %d: %s", entry.Id, err.Error())
+			repository.DeleteQueuedAccounting(entry.Id)
+			continue
+		}
+
+		if err := sendAccountingRequest(repository, request); err != nil {
+			attempts := entry.Attempts + 1
+			if errRetry := repository.RetryQueuedAccounting(entry.Id, attempts, now+accountingRetryBackoff(attempts)); errRetry != nil {
+				log.Errorf("flushAccounting: unable to postpone request %d: %s", entry.Id, errRetry.Error())
+			}
+			return sent, err
+		}
+
+		if err := repository.DeleteQueuedAccounting(entry.Id); err != nil {
+			return sent, err
+		}
+		sent++
+
+		log.Infof("flushAccounting: sent request %d of session %s after %d seconds", entry.Id, entry.SessionId, now-entry.CreatedAt)
+	}
+
+	return sent, nil
+}
+
+// queuedAccountingRequest rebuilds a queued request with a new Identifier and
+// the time it spent in the queue as Acct-Delay-Time (RFC 2866 section 5.2)
+func queuedAccountingRequest(entry QueuedAccounting, now int64) (*Packet, error) {
+	stored, err := DecodePacket(entry.Packet)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := NewPacket(CodeAccountingRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Attributes = stored.Attributes
+	request.Del(AttrAcctDelayTime)
+	if now > entry.CreatedAt {
+		request.AddInteger(AttrAcctDelayTime, uint32(now-entry.CreatedAt))
+	}
+
+	return request, nil
+}
+
+func accountingRetryBackoff(attempts int) int64 {
+	delay := int64(accountingRetryDelay)
+	for i := 1; i < attempts && delay < maxAccountingRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxAccountingRetryDelay {
+		delay = maxAccountingRetryDelay
+	}
+	return delay
+}
+
+//code 13
+func accountingFlush(repository *SQLiteRepository) {
+	sent, err := flushAccounting(repository, time.Now().Unix())
+	if err != nil {
+		log.Errorf("accountingFlush: sent %d queued requests, then failed with %s", sent, err.Error())
+		os.Exit(130)
+	}
+
+	log.Infof("accountingFlush: sent %d queued requests", sent)
+	os.Exit(0)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAccountingQueue(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	secret := "s3cr3t"
+	var mutex sync.Mutex
+	var received []*Packet
+	answering := false
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, request)
+		if !answering {
+			return nil
+		}
+		return encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	})
+
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+	retries := 0
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret, Timeout: 0.2, Retries: &retries}}
+	config.Radius.Deadline = 1
+
+	client := &OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", SessionId: "65A1F2C3-9F86D081884C7D65"}
+	start, _ := newAccountingRequest(AcctStatusTypeStart, client, "10.8.0.6")
+	stop, _ := newAccountingRequest(AcctStatusTypeStop, client, "10.8.0.6")
+
+	if err := deliverAccountingRequest(repository, start); err != nil {
+		t.Fatalf("Expected the Start to be queued, got %v", err)
+	}
+	// The Stop waits behind the queued Start without being sent
+	if err := deliverAccountingRequest(repository, stop); err != nil {
+		t.Fatalf("Expected the Stop to be queued, got %v", err)
+	}
+
+	mutex.Lock()
+	if len(received) != 1 {
+		t.Fatalf("Expected only the Start to be sent, got %d requests", len(received))
+	}
+	mutex.Unlock()
+
+	queued, _ := repository.QueuedAccounting()
+	if len(queued) != 2 {
+		t.Fatalf("Expected two queued requests, got %d", len(queued))
+	}
+	now := queued[0].CreatedAt
+
+	if _, err := flushAccounting(repository, now); err == nil {
+		t.Fatalf("Expected the flush to fail while the server is down")
+	}
+	if queued, _ := repository.QueuedAccounting(); queued[0].Attempts != 1 || queued[0].NextAttemptAt != now+accountingRetryDelay {
+		t.Fatalf("Expected the Start to be postponed, got %+v", queued[0])
+	}
+
+	// Nothing is due before the backoff ran out
+	if sent, err := flushAccounting(repository, now+10); sent != 0 || err != nil {
+		t.Fatalf("Expected nothing to be sent, got %d, %v", sent, err)
+	}
+
+	mutex.Lock()
+	answering = true
+	received = nil
+	mutex.Unlock()
+
+	if sent, err := flushAccounting(repository, now+60); sent != 2 || err != nil {
+		t.Fatalf("Expected two requests to be sent, got %d, %v", sent, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected Start and Stop, got %d requests", len(received))
+	}
+	for i, expected := range []uint32{AcctStatusTypeStart, AcctStatusTypeStop} {
+		if statusType, _ := received[i].GetInteger(AttrAcctStatusType); statusType != expected {
+			t.Fatalf("Expected status type %d at %d, got %d", expected, i, statusType)
+		}
+		if delay, _ := received[i].GetInteger(AttrAcctDelayTime); delay < 60 {
+			t.Fatalf("Expected Acct-Delay-Time of the time in the queue, got %d", delay)
+		}
+	}
+
+	if queued, _ := repository.QueuedAccounting(); len(queued) != 0 {
+		t.Fatalf("Expected an empty queue, got %d requests", len(queued))
+	}
+}
+
+func TestAccountingRetryBackoff(t *testing.T) {
+	for attempts, expected := range map[int]int64{1: 30, 2: 60, 3: 120, 20: maxAccountingRetryDelay} {
+		if delay := accountingRetryBackoff(attempts); delay != expected {
+			t.Fatalf("Expected backoff %d after %d attempts, got %d", expected, attempts, delay)
+		}
+	}
+}
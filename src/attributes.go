@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	attributeTypeString  = "string"
+	attributeTypeInteger = "integer"
+	attributeTypeIPAddr  = "ipaddr"
+
+	attributeTypeIPv6Addr   = "ipv6addr"
+	attributeTypeIPv6Prefix = "ipv6prefix"
+)
+
+var (
+	ErrUnknownAttribute     = errors.New("unknown radius attribute")
+	ErrUnknownAttributeType = errors.New("unknown radius attribute type")
+)
+
+// attributeDataTypes lists the attributes that are not strings
+var attributeDataTypes = map[AttributeType]string{
+	AttrNASIPAddress:        attributeTypeIPAddr,
+	AttrNASPort:             attributeTypeInteger,
+	AttrServiceType:         attributeTypeInteger,
+	AttrFramedProtocol:      attributeTypeInteger,
+	AttrFramedIPAddress:     attributeTypeIPAddr,
+	AttrFramedIPNetmask:     attributeTypeIPAddr,
+	AttrSessionTimeout:      attributeTypeInteger,
+	AttrIdleTimeout:         attributeTypeInteger,
+	AttrTerminationAction:   attributeTypeInteger,
+	AttrAcctAuthentic:       attributeTypeInteger,
+	AttrEventTimestamp:      attributeTypeInteger,
+	AttrNASPortType:         attributeTypeInteger,
+	AttrAcctInterimInterval: attributeTypeInteger,
+	AttrNASIPv6Address:      attributeTypeIPv6Addr,
+	AttrFramedIPv6Prefix:    attributeTypeIPv6Prefix,
+	AttrFramedIPv6Address:   attributeTypeIPv6Addr,
+}
+
+// defaultRequestAttributes are sent in Access-Request and Accounting-Request
+// unless Radius.Attributes configures the attributes of the packet type
+func defaultRequestAttributes() []ConfigAttribute {
+	return []ConfigAttribute{
+		{Name: "Service-Type", Value: config.ServerInfo.ServiceType},
+		{Name: "Framed-Protocol", Value: strconv.Itoa(int(FramedProtocolPPP))},
+		{Name: "NAS-Port-Type", Value: config.ServerInfo.PortType},
+		// OpenVPN sets one of them, depending on the protocol of the client
+		{Name: "Calling-Station-Id", Value: "${untrusted_ip}"},
+		{Name: "Calling-Station-Id", Value: "${untrusted_ip6}"},
+		{Name: "Called-Station-Id", Value: config.ServerInfo.IpAddress},
+	}
+}
+
+func accessRequestAttributes() []ConfigAttribute {
+	if config.Radius.Attributes.AccessRequest != nil {
+		return config.Radius.Attributes.AccessRequest
+	}
+	return defaultRequestAttributes()
+}
+
+func accountingRequestAttributes() []ConfigAttribute {
+	if config.Radius.Attributes.AccountingRequest != nil {
+		return config.Radius.Attributes.AccountingRequest
+	}
+	return defaultRequestAttributes()
+}
+
+// validate checks the names and types of the configured attributes, their
+// values are only known with the OpenVPN environment
+func (a ConfigAttributes) validate() error {
+	for _, attribute := range append(append([]ConfigAttribute{}, a.AccessRequest...), a.AccountingRequest...) {
+		if _, _, err := attribute.definition(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// definition returns the attribute number and data type. Attributes are named
+// as in the dictionary, or by number with an explicit Type
+func (a ConfigAttribute) definition() (AttributeType, string, error) {
+	var attributeType AttributeType
+
+	if number, err := strconv.ParseUint(a.Name, 10, 8); err == nil && number > 0 {
+		attributeType = AttributeType(number)
+	} else {
+		found := false
+		for candidate, name := range attributeNames {
+			if strings.EqualFold(name, a.Name) {
+				attributeType, found = candidate, true
+				break
+			}
+		}
+		if !found {
+			return 0, "", errors.New(ErrUnknownAttribute.Error() + " " + a.Name)
+		}
+	}
+
+	dataType := a.Type
+	if len(dataType) == 0 {
+		dataType = attributeTypeString
+		if known, ok := attributeDataTypes[attributeType]; ok {
+			dataType = known
+		}
+	}
+
+	switch dataType {
+	case attributeTypeString, attributeTypeInteger, attributeTypeIPAddr, attributeTypeIPv6Addr, attributeTypeIPv6Prefix:
+		return attributeType, dataType, nil
+	default:
+		return 0, "", errors.New(ErrUnknownAttributeType.Error() + " " + dataType)
+	}
+}
+
+// accountingAttributes expands the Accounting-Request attributes at Start.
+// Later requests of the session, such as Interim-Updates, have no OpenVPN
+// environment and send the stored attributes
+func accountingAttributes(env environment) ([]byte, error) {
+	packet := &Packet{Code: CodeAccountingRequest}
+	if err := addAttributes(packet, accountingRequestAttributes(), env); err != nil {
+		return nil, err
+	}
+	return packet.marshal(nil)
+}
+
+// accessAttributes expands the Access-Request attributes at authentication.
+// The re-authorization of the session has no OpenVPN environment and sends
+// the stored attributes
+func accessAttributes(env environment) ([]byte, error) {
+	packet := &Packet{Code: CodeAccessRequest}
+	if err := addAttributes(packet, accessRequestAttributes(), env); err != nil {
+		return nil, err
+	}
+	return packet.marshal(nil)
+}
+
+// addAttributes adds the attributes with their values expanded over the
+// OpenVPN environment, ${name} or $name is replaced by the variable. An
+// attribute whose value expands to nothing is left out
+func addAttributes(request *Packet, attributes []ConfigAttribute, env environment) error {
+	for _, attribute := range attributes {
+		attributeType, dataType, err := attribute.definition()
+		if err != nil {
+			return err
+		}
+
+		value := os.Expand(attribute.Value, env.Get)
+		if len(value) == 0 {
+			continue
+		}
+
+		switch dataType {
+		case attributeTypeInteger:
+			number, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return errors.New("invalid integer for " + attribute.Name + ": " + value)
+			}
+			request.AddInteger(attributeType, uint32(number))
+		case attributeTypeIPAddr:
+			if err := request.AddIPAddress(attributeType, net.ParseIP(value)); err != nil {
+				return errors.New("invalid address for " + attribute.Name + ": " + value)
+			}
+		case attributeTypeIPv6Addr:
+			if err := request.AddIPv6Address(attributeType, net.ParseIP(value)); err != nil {
+				return errors.New("invalid IPv6 address for " + attribute.Name + ": " + value)
+			}
+		case attributeTypeIPv6Prefix:
+			_, prefix, err := net.ParseCIDR(value)
+			if err == nil {
+				err = request.AddIPv6Prefix(attributeType, prefix)
+			}
+			if err != nil {
+				return errors.New("invalid IPv6 prefix for " + attribute.Name + ": " + value)
+			}
+		default:
+			request.AddString(attributeType, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDefaultRequestAttributes(t *testing.T) {
+	env := environment{"untrusted_ip": "192.0.2.10", "untrusted_port": "50000"}
+
+	request, err := newAccessRequest(env, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if calling, _ := request.GetString(AttrCallingStationId); calling != "192.0.2.10" {
+		t.Fatalf("Calling-Station-Id must be the client address, got %q", calling)
+	}
+	if called, _ := request.GetString(AttrCalledStationId); called != config.ServerInfo.IpAddress {
+		t.Fatalf("Called-Station-Id must be the server address, got %q", called)
+	}
+	if framedProtocol, _ := request.GetInteger(AttrFramedProtocol); framedProtocol != FramedProtocolPPP {
+		t.Fatalf("Unexpected Framed-Protocol %d", framedProtocol)
+	}
+
+	attributes, err := accountingAttributes(env)
+	if err != nil {
+		t.Fatalf("Failed to expand accounting attributes: %v", err)
+	}
+	client := &OVPNClient{CommonName: "alice", SessionId: "65A1F2C3-9F86D081884C7D65", AccountingAttributes: attributes}
+	accounting, err := newAccountingRequest(AcctStatusTypeInterimUpdate, client, "10.8.0.6")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if calling, _ := accounting.GetString(AttrCallingStationId); calling != "192.0.2.10" {
+		t.Fatalf("Interim-Update must carry the stored Calling-Station-Id, got %q", calling)
+	}
+}
+
+func TestIPv6RequestAttributes(t *testing.T) {
+	serverInfo := config.ServerInfo
+	defer func() { config.ServerInfo = serverInfo }()
+	config.ServerInfo.IpAddress = "2001:db8::1"
+	config.ServerInfo.Ipv6Address = "2001:db8::1"
+
+	env := environment{"untrusted_ip6": "2001:db8:1::10", "untrusted_port": "50000"}
+	if clientId := env.clientId(); clientId != "2001:db8:1::10:50000" {
+		t.Fatalf("Unexpected client id %q", clientId)
+	}
+
+	request, err := newAccessRequest(env, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if _, ok := request.Get(AttrNASIPAddress); ok {
+		t.Fatalf("NAS-IP-Address must not be sent for an IPv6 server")
+	}
+	if ip, _ := request.GetIPv6Address(AttrNASIPv6Address); ip.String() != "2001:db8::1" || len(request.GetAll(AttrNASIPv6Address)) != 1 {
+		t.Fatalf("Unexpected NAS-IPv6-Address %q", request.GetAll(AttrNASIPv6Address))
+	}
+	if calling := request.GetAll(AttrCallingStationId); len(calling) != 1 || string(calling[0]) != "2001:db8:1::10" {
+		t.Fatalf("Calling-Station-Id must be the IPv6 client address, got %q", calling)
+	}
+
+	client := &OVPNClient{CommonName: "alice", SessionId: "65A1F2C3-9F86D081884C7D65", Ipv6Address: "2001:db8:ffff::1000"}
+	accounting, err := newAccountingRequest(AcctStatusTypeStart, client, "10.8.0.6")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if ip, _ := accounting.GetIPv6Address(AttrFramedIPv6Address); ip.String() != "2001:db8:ffff::1000" {
+		t.Fatalf("Unexpected Framed-IPv6-Address %v", ip)
+	}
+	// Accounting requests identify the NAS like the Access-Request
+	if nas := accounting.GetAll(AttrNASIPv6Address); len(nas) != 1 || len(accounting.GetAll(AttrNASIdentifier)) != 1 {
+		t.Fatalf("Unexpected NAS attributes %+v", accounting.Attributes)
+	}
+}
+
+func TestConfiguredRequestAttributes(t *testing.T) {
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+
+	config.Radius.Attributes = ConfigAttributes{
+		AccessRequest: []ConfigAttribute{
+			{Name: "calling-station-id", Value: "${untrusted_ip}:${untrusted_port}"},
+			{Name: "Connect-Info", Type: "string"},
+			{Name: "77", Type: "string", Value: "OpenVPN ${IV_VER} on ${IV_PLAT}"},
+			{Name: "NAS-Port", Value: "${untrusted_port}"},
+			{Name: "Filter-Id", Value: "${tls_serial_0}"},
+		},
+		AccountingRequest: []ConfigAttribute{},
+	}
+	if err := config.Radius.Attributes.validate(); err == nil {
+		t.Fatalf("Expected attributes without a known name to be refused")
+	}
+
+	config.Radius.Attributes.AccessRequest = append(config.Radius.Attributes.AccessRequest[:1], config.Radius.Attributes.AccessRequest[2:]...)
+	if err := config.Radius.Attributes.validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	env := environment{"untrusted_ip": "192.0.2.10", "untrusted_port": "50000", "IV_VER": "2.6.8", "IV_PLAT": "linux"}
+	request, err := newAccessRequest(env, "alice", "secret")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if calling, _ := request.GetString(AttrCallingStationId); calling != "192.0.2.10:50000" {
+		t.Fatalf("Unexpected Calling-Station-Id %q", calling)
+	}
+	if info, _ := request.GetString(77); info != "OpenVPN 2.6.8 on linux" {
+		t.Fatalf("Unexpected Connect-Info %q", info)
+	}
+	if port, _ := request.GetInteger(AttrNASPort); port != 50000 {
+		t.Fatalf("Unexpected NAS-Port %d", port)
+	}
+	// Variables missing from the environment leave the attribute out
+	if _, ok := request.Get(AttrFilterId); ok {
+		t.Fatalf("Filter-Id without tls_serial_0 must not be sent")
+	}
+	if _, ok := request.Get(AttrServiceType); ok {
+		t.Fatalf("Configured attributes replace the defaults")
+	}
+
+	if attributes, err := accountingAttributes(env); err != nil || len(attributes) != packetHeaderLength {
+		t.Fatalf("Expected no accounting attributes, got %v, %v", attributes, err)
+	}
+
+	env["untrusted_port"] = "not-a-port"
+	if _, err := newAccessRequest(env, "alice", "secret"); err == nil {
+		t.Fatalf("Expected an invalid integer to be refused")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Challenges not answered within this many seconds are discarded
+	challengeLifetime = 300
+
+	dynamicChallengePrefix = "CRV1::"
+	staticChallengePrefix  = "SCRV1:"
+
+	staticChallengeConcat    = "concat"
+	staticChallengeRound     = "challenge"
+	staticChallengeAttribute = "attribute"
+)
+
+var (
+	ErrChallengeMismatch   = errors.New("challenge was issued for another user")
+	ErrStaticChallenge     = errors.New("malformed static challenge password")
+	ErrStaticChallengeMode = errors.New("unknown static challenge mode")
+)
+
+// parseDynamicChallengeResponse splits a "CRV1::state_id::response" password
+// sent by the client after a dynamic challenge
+func parseDynamicChallengeResponse(password string) (string, string, bool) {
+	if !strings.HasPrefix(password, dynamicChallengePrefix) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(password, dynamicChallengePrefix), "::", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// parseStaticChallenge splits a "SCRV1:base64(password):base64(response)"
+// password sent by clients configured with static-challenge
+func parseStaticChallenge(password string) (string, string, bool, error) {
+	if !strings.HasPrefix(password, staticChallengePrefix) {
+		return "", "", false, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(password, staticChallengePrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", true, ErrStaticChallenge
+	}
+
+	staticPassword, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", true, ErrStaticChallenge
+	}
+
+	response, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", true, ErrStaticChallenge
+	}
+
+	return string(staticPassword), string(response), true, nil
+}
+
+// staticChallenge is the OTP of a static challenge password that is not
+// concatenated to the password
+type staticChallenge struct {
+	mode     string
+	response string
+}
+
+// splitStaticChallenge returns the password to send in the first
+// Access-Request and, unless the OTP was concatenated to it, the OTP to send
+// separately as configured in Radius.StaticChallenge
+func splitStaticChallenge(password string) (string, *staticChallenge, error) {
+	staticPassword, response, ok, err := parseStaticChallenge(password)
+	if !ok || err != nil {
+		return password, nil, err
+	}
+
+	settings := config.Radius.StaticChallenge
+
+	switch settings.Mode {
+	case "", staticChallengeConcat:
+		return staticPassword + settings.Separator + response, nil, nil
+	case staticChallengeRound:
+		return staticPassword, &staticChallenge{mode: settings.Mode, response: response}, nil
+	case staticChallengeAttribute:
+		if settings.Attribute <= 0 || settings.Attribute > 255 {
+			return "", nil, errors.New("static challenge attribute must be between 1 and 255")
+		}
+		return staticPassword, &staticChallenge{mode: settings.Mode, response: response}, nil
+	default:
+		return "", nil, ErrStaticChallengeMode
+	}
+}
+
+// addTo adds the OTP in the configured attribute for the "attribute" mode
+func (c *staticChallenge) addTo(request *Packet) {
+	if c != nil && c.mode == staticChallengeAttribute {
+		request.AddString(AttributeType(config.Radius.StaticChallenge.Attribute), c.response)
+	}
+}
+
+// answers tells whether the OTP should answer this reply in a second
+// Access-Request, as done for the "challenge" mode
+func (c *staticChallenge) answers(response *Packet) bool {
+	return c != nil && c.mode == staticChallengeRound && response.Code == CodeAccessChallenge
+}
+
+// issueChallenge passes an Access-Challenge on to the client and returns the
+// exit code for OpenVPN. Deferred authentications use pending auth with a
+// CR_TEXT challenge when OpenVPN provides an auth_pending_file and the client
+// announced IV_SSO=crtext, everything else the CRV1 dynamic challenge
+func issueChallenge(repository *SQLiteRepository, env environment, username string, response *Packet) int {
+	pendingFile := env.Get("auth_pending_file")
+
+	if deferredAuth() && len(pendingFile) > 0 && strings.Contains(env.Get("IV_SSO"), "crtext") {
+		clientId := pendingChallengeId(env.clientId())
+		if err := repository.DeleteChallenge(clientId); err != nil {
+			log.Errorf("authenticate: unable to replace challenge %s", err.Error())
+			return 38
+		}
+
+		challenge, err := newChallenge(repository, clientId, username, response)
+		if err != nil {
+			log.Errorf("authenticate: unable to save challenge %s", err.Error())
+			return 38
+		}
+
+		if err := os.WriteFile(pendingFile, []byte(pendingChallengeText(challenge, challengeEcho(response))), 0600); err != nil {
+			log.Errorf("authenticate: unable to write auth_pending_file %s", err.Error())
+			return 38
+		}
+
+		log.Info("authenticate: sent pending challenge to user '" + username + "'")
+		return 2
+	}
+
+	challenge, err := newChallenge(repository, "", username, response)
+	if err != nil {
+		log.Errorf("authenticate: unable to save challenge %s", err.Error())
+		return 38
+	}
+
+	if err := writeDynamicChallenge(env, challenge, challengeEcho(response)); err != nil {
+		log.Errorf("authenticate: unable to send challenge %s", err.Error())
+		return 38
+	}
+
+	log.Info("authenticate: sent challenge " + challenge.Id + " to user '" + username + "'")
+	return 39
+}
+
+// afterHook drops the auth_pending_file of an authentication that finishes
+// after its hook returned. OpenVPN reads that file only when the hook returns,
+// so the challenge goes to the client as CRV1 through auth_failed_reason_file
+func afterHook(env environment) environment {
+	delete(env, "auth_pending_file")
+	return env
+}
+
+// pendingChallengeId derives the id of a pending challenge from the client,
+// since the response arrives on the same connection. It is hex encoded so
+// IPv6 addresses do not clash with the "::" CRV1 separator
+func pendingChallengeId(clientId string) string {
+	return "pending-" + hex.EncodeToString([]byte(clientId))
+}
+
+// newChallenge stores the State and Reply-Message of an Access-Challenge and
+// returns the challenge. A random state id is used when id is empty
+func newChallenge(repository *SQLiteRepository, id string, username string, response *Packet) (*Challenge, error) {
+	if len(id) == 0 {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		id = hex.EncodeToString(random)
+	}
+
+	state, _ := response.Get(AttrState)
+
+	var replyMessage []string
+	for _, message := range response.GetAll(AttrReplyMessage) {
+		replyMessage = append(replyMessage, string(message))
+	}
+
+	now := time.Now().Unix()
+	challenge := Challenge{
+		Id:           id,
+		Username:     username,
+		State:        state,
+		ReplyMessage: strings.Join(replyMessage, " "),
+		CreatedAt:    now,
+	}
+
+	if err := repository.CreateChallenge(challenge, now-challengeLifetime); err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+// takeChallenge loads the challenge answered by the client and removes it, so
+// every challenge can only be answered once
+func takeChallenge(repository *SQLiteRepository, id string, username string) (*Challenge, error) {
+	challenge, err := repository.GetChallenge(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repository.DeleteChallenge(id); err != nil {
+		return nil, err
+	}
+
+	if challenge.CreatedAt < time.Now().Unix()-challengeLifetime {
+		return nil, ErrNotExists
+	}
+
+	if challenge.Username != username {
+		return nil, ErrChallengeMismatch
+	}
+
+	return challenge, nil
+}
+
+// challengeFlags returns the CRV1 and CR_TEXT flags: a response is required
+// and may be echoed or not
+func challengeFlags(echo bool) string {
+	if echo {
+		return "R,E"
+	}
+	return "R"
+}
+
+func challengeMessage(challenge *Challenge) string {
+	text := strings.NewReplacer("\r", " ", "\n", " ").Replace(challenge.ReplyMessage)
+	if len(text) == 0 {
+		text = "Enter response"
+	}
+	return text
+}
+
+// pendingChallengeText formats an auth_pending_file: the pending timeout, the
+// crtext method and the CR_TEXT:<flags>:<challenge_text> message
+func pendingChallengeText(challenge *Challenge, echo bool) string {
+	return strconv.Itoa(challengeLifetime) + "\ncrtext\nCR_TEXT:" + challengeFlags(echo) + ":" + challengeMessage(challenge) + "\n"
+}
+
+// dynamicChallengeText formats the challenge for OpenVPN's dynamic challenge
+// protocol: CRV1:<flags>:<state_id>:<username_base64>:<challenge_text>
+func dynamicChallengeText(challenge *Challenge, echo bool) string {
+	return "CRV1:" + challengeFlags(echo) + ":" + challenge.Id + ":" + base64.StdEncoding.EncodeToString([]byte(challenge.Username)) + ":" + challengeMessage(challenge)
+}
+
+// challengeEcho tells whether the response may be echoed, following the
+// Prompt attribute (RFC 2869) and echoing when it is absent
+func challengeEcho(response *Packet) bool {
+	prompt, ok := response.GetInteger(AttrPrompt)
+	return !ok || prompt == PromptEcho
+}
+
+// writeDynamicChallenge hands the challenge to OpenVPN through the file named
+// by auth_failed_reason_file, which OpenVPN sends to the client as AUTH_FAILED
+func writeDynamicChallenge(env environment, challenge *Challenge, echo bool) error {
+	path := env.Get("auth_failed_reason_file")
+	if len(path) == 0 {
+		return errors.New("auth_failed_reason_file is not set, OpenVPN 2.5 or newer is required for challenges")
+	}
+
+	return os.WriteFile(path, []byte(dynamicChallengeText(challenge, echo)), 0600)
+}
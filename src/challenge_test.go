@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDynamicChallengeResponse(t *testing.T) {
+	stateId, response, ok := parseDynamicChallengeResponse("CRV1::0a1b2c::123456")
+	if !ok || stateId != "0a1b2c" || response != "123456" {
+		t.Fatalf("Unexpected parse result: %q %q %v", stateId, response, ok)
+	}
+
+	for _, password := range []string{"plainpassword", "CRV1::", "CRV1::::123456", "SCRV1:cGFzcw==:MTIz"} {
+		if _, _, ok := parseDynamicChallengeResponse(password); ok {
+			t.Fatalf("Password %q must not be treated as a challenge response", password)
+		}
+	}
+}
+
+func TestDynamicChallenge(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	response := &Packet{Code: CodeAccessChallenge}
+	response.AddString(AttrReplyMessage, "Enter your OTP\n")
+	response.AddString(AttrState, "radius-state")
+	response.AddInteger(AttrPrompt, PromptNoEcho)
+
+	challenge, err := newChallenge(repository, "", "testuser", response)
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+
+	reasonFile := filepath.Join(t.TempDir(), "auth_failed_reason")
+	env := environment{"auth_failed_reason_file": reasonFile}
+
+	if err := writeDynamicChallenge(env, challenge, challengeEcho(response)); err != nil {
+		t.Fatalf("Failed to write challenge: %v", err)
+	}
+
+	written, _ := os.ReadFile(reasonFile)
+	expected := "CRV1:R:" + challenge.Id + ":dGVzdHVzZXI=:Enter your OTP "
+	if string(written) != expected {
+		t.Fatalf("Unexpected challenge text: got %q, want %q", written, expected)
+	}
+
+	if _, err := takeChallenge(repository, challenge.Id, "otheruser"); err != ErrChallengeMismatch {
+		t.Fatalf("Expected ErrChallengeMismatch, got: %v", err)
+	}
+
+	// A challenge can only be answered once, even after a mismatch
+	if _, err := takeChallenge(repository, challenge.Id, "testuser"); err != ErrNotExists {
+		t.Fatalf("Expected ErrNotExists, got: %v", err)
+	}
+
+	challenge, _ = newChallenge(repository, "", "testuser", response)
+	taken, err := takeChallenge(repository, challenge.Id, "testuser")
+	if err != nil {
+		t.Fatalf("Failed to take challenge: %v", err)
+	}
+	if string(taken.State) != "radius-state" {
+		t.Fatalf("State mismatch: got %q", taken.State)
+	}
+}
+
+func TestSplitStaticChallenge(t *testing.T) {
+	settings := config.Radius.StaticChallenge
+	defer func() { config.Radius.StaticChallenge = settings }()
+
+	// base64("p4ss:word") and base64("123456")
+	password := "SCRV1:cDRzczp3b3Jk:MTIzNDU2"
+
+	config.Radius.StaticChallenge = ConfigStaticChallenge{Mode: staticChallengeConcat}
+	first, otp, err := splitStaticChallenge(password)
+	if err != nil || first != "p4ss:word123456" || otp != nil {
+		t.Fatalf("Unexpected concat result: %q %+v %v", first, otp, err)
+	}
+
+	config.Radius.StaticChallenge = ConfigStaticChallenge{Mode: staticChallengeRound}
+	first, otp, err = splitStaticChallenge(password)
+	if err != nil || first != "p4ss:word" || otp == nil || otp.response != "123456" {
+		t.Fatalf("Unexpected challenge result: %q %+v %v", first, otp, err)
+	}
+	if !otp.answers(&Packet{Code: CodeAccessChallenge}) || otp.answers(&Packet{Code: CodeAccessAccept}) {
+		t.Fatalf("OTP must only answer Access-Challenge")
+	}
+
+	config.Radius.StaticChallenge = ConfigStaticChallenge{Mode: staticChallengeAttribute, Attribute: int(AttrState)}
+	first, otp, err = splitStaticChallenge(password)
+	if err != nil || first != "p4ss:word" {
+		t.Fatalf("Unexpected attribute result: %q %+v %v", first, otp, err)
+	}
+	request, _ := NewPacket(CodeAccessRequest)
+	otp.addTo(request)
+	if value, _ := request.GetString(AttrState); value != "123456" {
+		t.Fatalf("OTP not added to the configured attribute: %q", value)
+	}
+
+	if first, otp, err = splitStaticChallenge("plainpassword"); err != nil || first != "plainpassword" || otp != nil {
+		t.Fatalf("Plain passwords must pass through: %q %+v %v", first, otp, err)
+	}
+	if _, _, err = splitStaticChallenge("SCRV1:not-base64"); err != ErrStaticChallenge {
+		t.Fatalf("Expected ErrStaticChallenge, got: %v", err)
+	}
+}
+
+func TestPendingChallenge(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	deferred := config.Radius.DeferredAuth
+	config.Radius.DeferredAuth = true
+	defer func() { config.Radius.DeferredAuth = deferred }()
+
+	directory := t.TempDir()
+	env := environment{
+		"auth_pending_file": filepath.Join(directory, "pending"),
+		"auth_control_file": filepath.Join(directory, "control"),
+		"untrusted_ip":      "2001:db8::1",
+		"untrusted_port":    "55606",
+		"IV_SSO":            "openurl,crtext",
+	}
+
+	response := &Packet{Code: CodeAccessChallenge}
+	response.AddString(AttrReplyMessage, "Enter your OTP")
+	response.AddString(AttrState, "radius-state")
+
+	if exitCode := issueChallenge(repository, env, "testuser", response); exitCode != 2 {
+		t.Fatalf("Expected pending exit code 2, got %d", exitCode)
+	}
+
+	pending, _ := os.ReadFile(filepath.Join(directory, "pending"))
+	if string(pending) != "300\ncrtext\nCR_TEXT:R,E:Enter your OTP\n" {
+		t.Fatalf("Unexpected auth_pending_file: %q", pending)
+	}
+
+	// The client response is answered like a CRV1 response for the pending state id
+	stateId, _, ok := parseDynamicChallengeResponse(dynamicChallengePrefix + pendingChallengeId("2001:db8::1:55606") + "::123456")
+	if !ok {
+		t.Fatalf("Pending state id must survive the CRV1 format")
+	}
+	if _, err := takeChallenge(repository, stateId, "testuser"); err != nil {
+		t.Fatalf("Failed to take pending challenge: %v", err)
+	}
+
+	if err := writeAuthControlFile(env, 2); err != nil {
+		t.Fatalf("Failed to handle pending result: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "control")); !os.IsNotExist(err) {
+		t.Fatalf("Pending result must not write auth_control_file")
+	}
+
+	writeAuthControlFile(env, 0)
+	if control, _ := os.ReadFile(filepath.Join(directory, "control")); string(control) != "1" {
+		t.Fatalf("Expected accepted auth_control_file, got %q", control)
+	}
+
+	writeAuthControlFile(env, 36)
+	if control, _ := os.ReadFile(filepath.Join(directory, "control")); string(control) != "0" {
+		t.Fatalf("Expected rejected auth_control_file, got %q", control)
+	}
+
+	// Clients without crtext and authentications finishing after the hook
+	// returned get a CRV1 challenge and a failed auth_control_file
+	reasonFile := filepath.Join(directory, "reason")
+	for _, env := range []environment{
+		{"auth_pending_file": filepath.Join(directory, "pending-plain"), "auth_failed_reason_file": reasonFile, "untrusted_ip": "192.0.2.10", "untrusted_port": "50000"},
+		afterHook(environment{"auth_pending_file": filepath.Join(directory, "pending-late"), "auth_failed_reason_file": reasonFile, "IV_SSO": "crtext", "untrusted_ip": "192.0.2.11", "untrusted_port": "50000"}),
+	} {
+		os.Remove(reasonFile)
+		if exitCode := issueChallenge(repository, env, "testuser", response); exitCode != 39 {
+			t.Fatalf("Expected challenge exit code 39, got %d", exitCode)
+		}
+		if reason, _ := os.ReadFile(reasonFile); !strings.HasPrefix(string(reason), "CRV1:R,E:") {
+			t.Fatalf("Expected CRV1 challenge, got %q", reason)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(directory, "pending-plain")); !os.IsNotExist(err) {
+		t.Fatalf("A client without crtext must not get auth_pending_file")
+	}
+	if _, err := os.Stat(filepath.Join(directory, "pending-late")); !os.IsNotExist(err) {
+		t.Fatalf("auth_pending_file must not be written after the hook returned")
+	}
+
+	writeAuthControlFile(env, 39)
+	if control, _ := os.ReadFile(filepath.Join(directory, "control")); string(control) != "0" {
+		t.Fatalf("Expected failed auth_control_file for a CRV1 challenge, got %q", control)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// framedAddress returns the Framed-IP-Address and Framed-IP-Netmask of an
+// Access-Accept. 255.255.255.254 asks the NAS to select the address and
+// 255.255.255.255 lets the user select it (RFC 2865 section 5.8), both leave
+// the address to the OpenVPN pool
+func framedAddress(response *Packet) (string, string) {
+	ip, ok := response.GetIPAddress(AttrFramedIPAddress)
+	if !ok || ip.Equal(net.IPv4(255, 255, 255, 254)) || ip.Equal(net.IPv4bcast) {
+		return "", ""
+	}
+
+	var netmask string
+	if mask, ok := response.GetIPAddress(AttrFramedIPNetmask); ok {
+		netmask = mask.String()
+	}
+
+	return ip.String(), netmask
+}
+
+// framedIPv6Address returns the IPv6 address of an Access-Accept: the
+// Framed-IPv6-Address (RFC 6911), a /128 Framed-IPv6-Prefix or the
+// Framed-Interface-Id within the Framed-IPv6-Prefix (RFC 3162), the latter
+// with the prefix length. A Framed-Interface-Id without prefix is returned
+// as hex, it is placed in the server network at client-connect
+func framedIPv6Address(response *Packet) (string, string) {
+	if ip, ok := response.GetIPv6Address(AttrFramedIPv6Address); ok {
+		return ip.String(), ""
+	}
+
+	prefix, hasPrefix := response.GetIPv6Prefix(AttrFramedIPv6Prefix)
+	interfaceId, hasInterfaceId := response.Get(AttrFramedInterfaceId)
+	hasInterfaceId = hasInterfaceId && len(interfaceId) == 8
+
+	switch {
+	case hasPrefix && prefixLength(prefix) == 128:
+		return prefix.IP.String(), ""
+	case hasPrefix && hasInterfaceId:
+		if ip := interfaceAddress(prefix.IP, prefixLength(prefix), interfaceId); ip != nil {
+			return ip.String() + "/" + strconv.Itoa(prefixLength(prefix)), ""
+		}
+		log.Warnf("framedIPv6Address: ignoring Framed-Interface-Id in Framed-IPv6-Prefix %s", prefix)
+		return "", ""
+	case hasInterfaceId:
+		return "", hex.EncodeToString(interfaceId)
+	}
+
+	return "", ""
+}
+
+// delegatedPrefix returns a Framed-IPv6-Prefix that holds no address of the
+// client, the client routes it like a Framed-IPv6-Route
+func delegatedPrefix(response *Packet) (string, bool) {
+	prefix, ok := response.GetIPv6Prefix(AttrFramedIPv6Prefix)
+	if !ok || prefixLength(prefix) == 128 {
+		return "", false
+	}
+	if _, ok := response.GetIPv6Address(AttrFramedIPv6Address); ok {
+		return prefix.String(), true
+	}
+	if interfaceId, ok := response.Get(AttrFramedInterfaceId); ok && len(interfaceId) == 8 {
+		return "", false
+	}
+	return prefix.String(), true
+}
+
+func prefixLength(prefix *net.IPNet) int {
+	ones, _ := prefix.Mask.Size()
+	return ones
+}
+
+// interfaceAddress places the 64 bit interface id in the network, which must
+// be an IPv6 prefix of at most 64 bits
+func interfaceAddress(network net.IP, bits int, interfaceId []byte) net.IP {
+	if network.To4() != nil || network.To16() == nil || bits > 64 || len(interfaceId) != 8 {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, network.To16().Mask(net.CIDRMask(bits, 8*net.IPv6len))[:8])
+	copy(ip[8:], interfaceId)
+	return ip
+}
+
+// framedRoutes returns the prefixes of the Framed-Route and Framed-IPv6-Route
+// attributes of an Access-Accept in CIDR notation, with a delegated
+// Framed-IPv6-Prefix
+func framedRoutes(response *Packet) []string {
+	var routes []string
+
+	for _, value := range response.GetAll(AttrFramedRoute) {
+		if route, ok := parseFramedRoute(string(value), false); ok {
+			routes = append(routes, route)
+		} else {
+			log.Warnf("framedRoutes: ignoring malformed Framed-Route %q", value)
+		}
+	}
+
+	for _, value := range response.GetAll(AttrFramedIPv6Route) {
+		if route, ok := parseFramedRoute(string(value), true); ok {
+			routes = append(routes, route)
+		} else {
+			log.Warnf("framedRoutes: ignoring malformed Framed-IPv6-Route %q", value)
+		}
+	}
+
+	if prefix, ok := delegatedPrefix(response); ok {
+		routes = append(routes, prefix)
+	}
+
+	return routes
+}
+
+// parseFramedRoute reads the prefix of a route. Routes are the prefix followed
+// by the gateway and metrics (RFC 2865 section 5.22, RFC 3162 section 2.5);
+// IPv4 prefixes are also accepted as network and netmask or as a host address.
+// The gateway is not used, the route always goes through the client
+func parseFramedRoute(value string, ipv6 bool) (string, bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	prefix := fields[0]
+	if !ipv6 && !strings.Contains(prefix, "/") {
+		bits := 32
+		if len(fields) > 1 {
+			if ones, ok := routeNetmask(prefix, fields[1]); ok {
+				bits = ones
+			}
+		}
+		prefix += "/" + strconv.Itoa(bits)
+	}
+
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil || (network.IP.To4() == nil) != ipv6 {
+		return "", false
+	}
+
+	return network.String(), true
+}
+
+// routeNetmask tells whether the field after a network without prefix length
+// is its netmask rather than the gateway: a non-zero contiguous netmask that
+// leaves no host bits of the network. A gateway such as 0.0.0.0 would
+// otherwise turn the route into a default route
+func routeNetmask(network string, field string) (int, bool) {
+	ip := net.ParseIP(network).To4()
+	mask := net.ParseIP(field).To4()
+	if ip == nil || mask == nil {
+		return 0, false
+	}
+
+	ones, size := net.IPMask(mask).Size()
+	if size != 32 || ones == 0 || !ip.Mask(net.IPMask(mask)).Equal(ip) {
+		return 0, false
+	}
+	return ones, true
+}
+
+// clientConfig returns the client-connect directives for the session
+func clientConfig(client *OVPNClient, env environment) []string {
+	var directives []string
+
+	if push, err := ifconfigPush(client, env); err != nil {
+		log.Warnf("clientConfig: %s of user '%s'", err.Error(), client.CommonName)
+	} else if len(push) > 0 {
+		directives = append(directives, push)
+	}
+
+	address, err := ipv6PushAddress(client, env)
+	if err != nil {
+		log.Warnf("clientConfig: %s of user '%s'", err.Error(), client.CommonName)
+	} else if len(address) > 0 {
+		directives = append(directives, "ifconfig-ipv6-push "+address)
+	}
+
+	if client.IdleTimeout > 0 {
+		directives = append(directives, "inactive "+strconv.Itoa(client.IdleTimeout))
+	}
+
+	routes := strings.Fields(client.FramedRoutes)
+	if network, ok := framedNetwork(client, env); ok {
+		routes = append([]string{network}, routes...)
+	}
+
+	// iroute only tells OpenVPN which client a subnet belongs to, the server
+	// config still needs a route for it
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			log.Warnf("clientConfig: ignoring stored route %q of user '%s'", route, client.CommonName)
+			continue
+		}
+
+		if network.IP.To4() != nil {
+			subnet := network.IP.String() + " " + net.IP(network.Mask).String()
+			directives = append(directives, "iroute "+subnet)
+			if config.OpenVPN.PushFramedRoutes {
+				directives = append(directives, "push \"route "+subnet+"\"")
+			}
+		} else {
+			directives = append(directives, "iroute-ipv6 "+network.String())
+			if config.OpenVPN.PushFramedRoutes {
+				directives = append(directives, "push \"route-ipv6 "+network.String()+"\"")
+			}
+		}
+	}
+
+	return directives
+}
+
+// ifconfigPush returns the ifconfig-push directive of the Framed-IP-Address,
+// none without one. The address is pushed with the netmask of the server
+// network under topology subnet, otherwise with its peer in the /30 of
+// topology net30
+func ifconfigPush(client *OVPNClient, env environment) (string, error) {
+	if len(client.FramedIPAddress) == 0 {
+		return "", nil
+	}
+
+	if netmask := env.Get("ifconfig_netmask"); len(netmask) > 0 {
+		return "ifconfig-push " + client.FramedIPAddress + " " + netmask, nil
+	}
+
+	ip := net.ParseIP(client.FramedIPAddress).To4()
+	if ip == nil || len(env.Get("ifconfig_remote")) == 0 {
+		return "", errors.New("no network to push Framed-IP-Address " + client.FramedIPAddress)
+	}
+
+	// The two hosts of a /30 are each other's peer
+	peer := make(net.IP, net.IPv4len)
+	copy(peer, ip)
+	switch ip[3] & 3 {
+	case 1:
+		peer[3]++
+	case 2:
+		peer[3]--
+	default:
+		return "", errors.New("Framed-IP-Address " + client.FramedIPAddress + " is no host of a net30 subnet")
+	}
+
+	return "ifconfig-push " + ip.String() + " " + peer.String(), nil
+}
+
+// framedNetwork returns the network given by Framed-IP-Address and
+// Framed-IP-Netmask, which is routed to the user (RFC 2865 section 5.9). A
+// host netmask routes nothing and a network holding the server address is
+// the tunnel network itself
+func framedNetwork(client *OVPNClient, env environment) (string, bool) {
+	ip := net.ParseIP(client.FramedIPAddress).To4()
+	mask := net.ParseIP(client.FramedIPNetmask).To4()
+	if ip == nil || mask == nil {
+		return "", false
+	}
+
+	ones, bits := net.IPMask(mask).Size()
+	if bits != 32 || ones == 0 || ones == 32 {
+		return "", false
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+	if local := net.ParseIP(env.Get("ifconfig_local")); local != nil && network.Contains(local) {
+		return "", false
+	}
+	return network.String(), true
+}
+
+// ipv6PushAddress returns the "address/bits" pushed for the IPv6 address of
+// the session. Addresses without prefix length get the one of the server
+// network (ifconfig_ipv6_netbits), which also holds a lone Framed-Interface-Id
+func ipv6PushAddress(client *OVPNClient, env environment) (string, error) {
+	if strings.Contains(client.FramedIPv6Address, "/") {
+		return client.FramedIPv6Address, nil
+	}
+	if len(client.FramedIPv6Address) == 0 && len(client.FramedInterfaceId) == 0 {
+		return "", nil
+	}
+
+	bits, err := strconv.Atoi(env.Get("ifconfig_ipv6_netbits"))
+	if err != nil {
+		return "", errors.New("no IPv6 network to push the address")
+	}
+
+	address := client.FramedIPv6Address
+	if len(address) == 0 {
+		interfaceId, _ := hex.DecodeString(client.FramedInterfaceId)
+		ip := interfaceAddress(net.ParseIP(env.Get("ifconfig_ipv6_local")), bits, interfaceId)
+		if ip == nil {
+			return "", errors.New("unable to place Framed-Interface-Id " + client.FramedInterfaceId + " in the IPv6 network")
+		}
+		address = ip.String()
+	}
+
+	return address + "/" + strconv.Itoa(bits), nil
+}
+
+// connectConfig returns the client-connect directives for the session of the
+// connecting client, none when it has no session
+func connectConfig(repository *SQLiteRepository, env environment) ([]string, error) {
+	client, err := repository.GetById(env.clientId())
+	if err == ErrNotExists {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return clientConfig(client, env), nil
+}
+
+// writeClientConfig writes the directives to the file OpenVPN passes to the
+// client-connect script
+func writeClientConfig(path string, directives []string) error {
+	if len(directives) == 0 {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strings.Join(directives, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClientConfig(t *testing.T) {
+	response := &Packet{Code: CodeAccessAccept}
+	response.AddIPAddress(AttrFramedIPAddress, net.ParseIP("10.8.0.50"))
+	response.AddIPAddress(AttrFramedIPNetmask, net.ParseIP("255.255.255.0"))
+
+	address, netmask := framedAddress(response)
+	if address != "10.8.0.50" || netmask != "255.255.255.0" {
+		t.Fatalf("Unexpected framed address %s %s", address, netmask)
+	}
+
+	// 255.255.255.254 leaves the address to the OpenVPN pool
+	pool := &Packet{Code: CodeAccessAccept}
+	pool.AddIPAddress(AttrFramedIPAddress, net.ParseIP("255.255.255.254"))
+	if address, _ := framedAddress(pool); address != "" {
+		t.Fatalf("Expected no framed address, got %s", address)
+	}
+
+	client := &OVPNClient{CommonName: "alice", FramedIPAddress: "10.8.0.50"}
+	env := environment{"ifconfig_netmask": "255.255.0.0"}
+	if directives := clientConfig(client, env); len(directives) != 1 || directives[0] != "ifconfig-push 10.8.0.50 255.255.0.0" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	// Framed-IP-Netmask is not the tunnel netmask, a network of the user is routed to it
+	client.FramedIPNetmask = "255.255.255.255"
+	if directives := clientConfig(client, env); len(directives) != 1 || directives[0] != "ifconfig-push 10.8.0.50 255.255.0.0" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	client = &OVPNClient{CommonName: "alice", FramedIPAddress: "172.16.5.1", FramedIPNetmask: "255.255.255.0"}
+	env = environment{"ifconfig_local": "10.8.0.1", "ifconfig_netmask": "255.255.0.0"}
+	if directives := clientConfig(client, env); strings.Join(directives, "\n") != "ifconfig-push 172.16.5.1 255.255.0.0\niroute 172.16.5.0 255.255.255.0" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	// A netmask covering the tunnel network routes nothing
+	client = &OVPNClient{CommonName: "alice", FramedIPAddress: "10.8.0.50", FramedIPNetmask: "255.255.255.0"}
+	if directives := clientConfig(client, env); len(directives) != 1 || directives[0] != "ifconfig-push 10.8.0.50 255.255.0.0" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	// topology net30 pushes the peer of the /30
+	net30 := environment{"ifconfig_local": "10.8.0.1", "ifconfig_remote": "10.8.0.2"}
+	if directives := clientConfig(&OVPNClient{CommonName: "alice", FramedIPAddress: "10.8.0.6"}, net30); len(directives) != 1 || directives[0] != "ifconfig-push 10.8.0.6 10.8.0.5" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+	if directives := clientConfig(&OVPNClient{CommonName: "alice", FramedIPAddress: "10.8.0.8"}, net30); len(directives) != 0 {
+		t.Fatalf("Expected no push for a net30 network address, got %q", directives)
+	}
+
+	if directives := clientConfig(&OVPNClient{CommonName: "bob"}, env); len(directives) != 0 {
+		t.Fatalf("Expected no directives, got %q", directives)
+	}
+}
+
+func TestFramedRoutes(t *testing.T) {
+	response := &Packet{Code: CodeAccessAccept}
+	response.AddString(AttrFramedRoute, "192.168.10.0/24 0.0.0.0 1")
+	response.AddString(AttrFramedRoute, "192.168.20.0 255.255.255.0 10.8.0.50 1")
+	response.AddString(AttrFramedRoute, "192.168.30.7")
+	// The gateway of a route without prefix length is not a netmask
+	response.AddString(AttrFramedRoute, "192.168.50.0 0.0.0.0 1")
+	response.AddString(AttrFramedRoute, "192.168.60.0 10.8.0.50 1")
+	response.AddString(AttrFramedRoute, "not a route")
+	response.AddString(AttrFramedIPv6Route, "2001:db8:1::/48 :: 1")
+	response.AddString(AttrFramedIPv6Route, "192.168.40.0/24")
+
+	routes := framedRoutes(response)
+	expected := []string{"192.168.10.0/24", "192.168.20.0/24", "192.168.30.7/32", "192.168.50.0/32", "192.168.60.0/32", "2001:db8:1::/48"}
+	if strings.Join(routes, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Unexpected routes %q", routes)
+	}
+
+	openVPN := config.OpenVPN
+	defer func() { config.OpenVPN = openVPN }()
+	config.OpenVPN.PushFramedRoutes = true
+
+	client := &OVPNClient{CommonName: "site", FramedRoutes: "192.168.10.0/24 2001:db8:1::/48"}
+	directives := clientConfig(client, environment{})
+	expected = []string{
+		"iroute 192.168.10.0 255.255.255.0",
+		"push \"route 192.168.10.0 255.255.255.0\"",
+		"iroute-ipv6 2001:db8:1::/48",
+		"push \"route-ipv6 2001:db8:1::/48\"",
+	}
+	if strings.Join(directives, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+}
+
+func TestFramedIPv6Address(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:5::/64")
+	interfaceId := []byte{0, 0, 0, 0, 0, 0, 0, 0x10}
+
+	response := &Packet{Code: CodeAccessAccept}
+	response.AddIPv6Prefix(AttrFramedIPv6Prefix, prefix)
+	response.Add(AttrFramedInterfaceId, interfaceId)
+	if address, id := framedIPv6Address(response); address != "2001:db8:0:5::10/64" || id != "" {
+		t.Fatalf("Unexpected address %q %q", address, id)
+	}
+	if routes := framedRoutes(response); len(routes) != 0 {
+		t.Fatalf("The prefix of the address must not be routed, got %q", routes)
+	}
+
+	// Without Framed-Interface-Id the prefix is delegated to the client
+	delegated := &Packet{Code: CodeAccessAccept}
+	delegated.AddIPv6Address(AttrFramedIPv6Address, net.ParseIP("2001:db8::7"))
+	delegated.AddIPv6Prefix(AttrFramedIPv6Prefix, prefix)
+	if address, _ := framedIPv6Address(delegated); address != "2001:db8::7" {
+		t.Fatalf("Unexpected address %q", address)
+	}
+	if routes := framedRoutes(delegated); strings.Join(routes, " ") != "2001:db8:0:5::/64" {
+		t.Fatalf("Unexpected routes %q", routes)
+	}
+
+	env := environment{"ifconfig_ipv6_local": "2001:db8:ffff::1", "ifconfig_ipv6_netbits": "64"}
+
+	client := &OVPNClient{CommonName: "alice", FramedIPv6Address: "2001:db8::7"}
+	if directives := clientConfig(client, env); len(directives) != 1 || directives[0] != "ifconfig-ipv6-push 2001:db8::7/64" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	// A lone Framed-Interface-Id is placed in the server network
+	lone := &Packet{Code: CodeAccessAccept}
+	lone.Add(AttrFramedInterfaceId, interfaceId)
+	address, id := framedIPv6Address(lone)
+	client = &OVPNClient{CommonName: "bob", FramedIPv6Address: address, FramedInterfaceId: id}
+	if directives := clientConfig(client, env); len(directives) != 1 || directives[0] != "ifconfig-ipv6-push 2001:db8:ffff::10/64" {
+		t.Fatalf("Unexpected directives %q", directives)
+	}
+
+	if directives := clientConfig(client, environment{}); len(directives) != 0 {
+		t.Fatalf("Expected no directives without IPv6 network, got %q", directives)
+	}
+}
+
+func TestAccountingFramedAddress(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", SessionId: "65A1F2C3-0000000000000001", FramedIPAddress: "10.8.0.50"})
+
+	secret := "s3cr3t"
+	requests := make(chan *Packet, 1)
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		requests <- request
+		return encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	})
+
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret}}
+	config.Radius.Deadline = 1
+
+	// Without a network to push Framed-IP-Address the client keeps its pool address
+	env := environment{"untrusted_ip": "192.0.2.10", "untrusted_port": "50000", "ifconfig_pool_remote_ip": "10.8.0.6"}
+	if exitCode := accounting(repository, env, "start"); exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", exitCode)
+	}
+
+	start := <-requests
+	if address, _ := start.GetIPAddress(AttrFramedIPAddress); !address.Equal(net.ParseIP("10.8.0.6")) {
+		t.Fatalf("Expected the pool address in the Start, got %s", address)
+	}
+}
@@ -1,25 +1,158 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configFile is read by the scripts and by the plugin unless its first
+// argument names another file
+const configFile string = "/etc/openvpn/plugin/config.json"
+
+var ErrConfigLogFile = errors.New("config file is null")
+
 type Config struct {
 	LogFile    string           `json:"LogFile"`
 	ServerInfo ConfigServerInfo `json:"ServerInfo"`
 	Radius     ConfigRadius     `json:"Radius"`
+	OpenVPN    ConfigOpenVPN    `json:"OpenVPN"`
+	Daemon     ConfigDaemon     `json:"Daemon"`
 }
 
+// ConfigServerInfo is the NAS identity. IpAddress may be an IPv4 or IPv6
+// address, Ipv6Address adds the IPv6 address of a dual stack server
 type ConfigServerInfo struct {
 	Identifier  string `json:"Identifier"`
 	IpAddress   string `json:"IpAddress"`
+	Ipv6Address string `json:"Ipv6Address"`
 	PortType    string `json:"PortType"`
 	ServiceType string `json:"ServiceType"`
 }
 
 type ConfigRadius struct {
-	AuthenticationOnly	bool		 `json:"AuthenticationOnly"`
-	Authentication 		ConfigServer `json:"Authentication"`
-	Accounting     		ConfigServer `json:"Accounting"`
+	AuthenticationOnly   bool                       `json:"AuthenticationOnly"`
+	Authentication       ConfigServerGroup          `json:"Authentication"`
+	Accounting           ConfigServerGroup          `json:"Accounting"`
+	InterimInterval      int                        `json:"InterimInterval"`
+	Deadline             float64                    `json:"Deadline"`
+	StaticChallenge      ConfigStaticChallenge      `json:"StaticChallenge"`
+	DeferredAuth         bool                       `json:"DeferredAuth"`
+	DynamicAuthorization ConfigDynamicAuthorization `json:"DynamicAuthorization"`
+	Attributes           ConfigAttributes           `json:"Attributes"`
+}
+
+// ConfigDynamicAuthorization configures the RFC 5176 listener of
+// "ovpn-radius dae". Only the listed clients are answered
+type ConfigDynamicAuthorization struct {
+	Listen  string                             `json:"Listen"`
+	Clients []ConfigDynamicAuthorizationClient `json:"Clients"`
+}
+
+// ConfigDynamicAuthorizationClient is a Disconnect-Request sender identified
+// by its IP address or network
+type ConfigDynamicAuthorizationClient struct {
+	Address                     string `json:"Address"`
+	Secret                      string `json:"Secret"`
+	RequireMessageAuthenticator bool   `json:"RequireMessageAuthenticator"`
 }
 
+// ConfigStaticChallenge selects how the OTP of an SCRV1 static challenge
+// password reaches RADIUS: "concat" (default), "challenge" or "attribute"
+type ConfigStaticChallenge struct {
+	Mode      string `json:"Mode"`
+	Separator string `json:"Separator"`
+	Attribute int    `json:"Attribute"`
+}
+
+// ConfigServerGroup is an ordered list of servers for one purpose. The
+// embedded ConfigServer keeps single server configurations working
+type ConfigServerGroup struct {
+	ConfigServer
+	Strategy  string         `json:"Strategy"`
+	DeadAfter int            `json:"DeadAfter"`
+	HoldDown  int            `json:"HoldDown"`
+	Servers   []ConfigServer `json:"Servers"`
+}
+
+// ConfigServer is one RADIUS server. Replies to Access-Requests must carry a
+// Message-Authenticator unless AllowMissingMessageAuthenticator is set for a
+// server that cannot send one
 type ConfigServer struct {
-	Server string `json:"Server"`
-	Secret string `json:"Secret"`
+	Server                           string  `json:"Server"`
+	Secret                           string  `json:"Secret"`
+	Weight                           int     `json:"Weight"`
+	Timeout                          float64 `json:"Timeout"`
+	Retries                          *int    `json:"Retries"`
+	Backoff                          float64 `json:"Backoff"`
+	AllowMissingMessageAuthenticator bool    `json:"AllowMissingMessageAuthenticator"`
+}
+
+// ConfigAttributes lists the attributes sent in each packet type next to the
+// ones ovpn-radius always sends. A list that is not configured falls back to
+// the defaults, an empty list sends none
+type ConfigAttributes struct {
+	AccessRequest     []ConfigAttribute `json:"AccessRequest"`
+	AccountingRequest []ConfigAttribute `json:"AccountingRequest"`
+}
+
+// ConfigAttribute is an attribute named as in the dictionary, or by number
+// with a Type of string, integer or ipaddr. Value may refer to OpenVPN
+// environment variables as ${name}
+type ConfigAttribute struct {
+	Name  string `json:"Name"`
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+type ConfigOpenVPN struct {
+	StatusFile         string `json:"StatusFile"`
+	Management         string `json:"Management"`
+	ManagementPassword string `json:"ManagementPassword"`
+	// PushFramedRoutes also pushes the Framed-Route subnets to the client
+	PushFramedRoutes bool `json:"PushFramedRoutes"`
+}
+
+// ConfigDaemon enables "ovpn-radius daemon". The hooks hand their work to the
+// daemon through Socket and fall back to running it themselves when the
+// daemon is not listening
+type ConfigDaemon struct {
+	Socket string `json:"Socket"`
+}
+
+// loadConfig reads the configuration and sends the log to its LogFile
+func loadConfig(path string) error {
+	byteValue, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var loaded Config
+	if err := json.Unmarshal(byteValue, &loaded); err != nil {
+		return err
+	}
+
+	if len(loaded.LogFile) <= 0 {
+		return ErrConfigLogFile
+	}
+
+	if err := loaded.Radius.Attributes.validate(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(loaded.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	config = loaded
+
+	log.SetOutput(file)
+
+	log.SetFormatter(&log.TextFormatter{FullTimestamp: true, PadLevelText: true})
+
+	return nil
 }
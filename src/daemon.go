@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// daemonTimeout bounds connecting to the daemon and reading a request. The
+// daemon answers within two RADIUS deadlines plus this margin
+const daemonTimeout = 10 * time.Second
+
+var ErrDaemonRunning = errors.New("daemon is already listening")
+
+// daemonRequest is sent by a hook to the daemon, one request per connection.
+// Type is the execution type of the hook
+type daemonRequest struct {
+	Type        string            `json:"Type"`
+	Environment map[string]string `json:"Environment"`
+	Username    string            `json:"Username,omitempty"`
+	Password    string            `json:"Password,omitempty"`
+	Response    string            `json:"Response,omitempty"`
+}
+
+// daemonResponse carries the exit code the hook reports to OpenVPN and, for
+// client-connect, the directives to write to the client config file
+type daemonResponse struct {
+	ExitCode int      `json:"ExitCode"`
+	Config   []string `json:"Config,omitempty"`
+}
+
+// daemon serves the hooks from a single process that keeps the configuration
+// and the database open
+type daemon struct {
+	repository *SQLiteRepository
+	tasks      sync.WaitGroup
+}
+
+//code 9
+func runDaemon(repository *SQLiteRepository) {
+	if len(config.Daemon.Socket) == 0 {
+		log.Errorf("runDaemon: Daemon.Socket is not configured")
+		os.Exit(90)
+	}
+
+	listener, err := listenDaemon(config.Daemon.Socket)
+	if err != nil {
+		log.Errorf("runDaemon: unable to listen on %s: %s", config.Daemon.Socket, err.Error())
+		os.Exit(91)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	log.Info("runDaemon: listening on " + config.Daemon.Socket)
+
+	d := &daemon{repository: repository}
+
+	stop := make(chan struct{})
+	d.tasks.Add(1)
+	go d.flushAccounting(stop)
+
+	d.serve(listener)
+	close(stop)
+
+	// Let running and deferred requests finish before closing the database
+	d.tasks.Wait()
+	repository.Close()
+
+	log.Info("runDaemon: stopped")
+	os.Exit(0)
+}
+
+// flushAccounting sends the queued accounting requests until stop is closed
+func (d *daemon) flushAccounting(stop chan struct{}) {
+	defer d.tasks.Done()
+
+	ticker := time.NewTicker(accountingFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if sent, err := flushAccounting(d.repository, time.Now().Unix()); err != nil {
+				log.Warnf("daemon: sent %d queued accounting requests, then failed with %s", sent, err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// listenDaemon replaces a socket left over by a previous daemon. The socket
+// is accessible to the group of the daemon, which must include the user
+// OpenVPN runs its hooks as
+func listenDaemon(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, daemonTimeout); err == nil {
+		conn.Close()
+		return nil, ErrDaemonRunning
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// serve accepts hook connections until the listener is closed
+func (d *daemon) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Errorf("daemon: accept failed with %s", err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		d.tasks.Add(1)
+		go func() {
+			defer d.tasks.Done()
+			d.serveConn(conn)
+		}()
+	}
+}
+
+func (d *daemon) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var request daemonRequest
+
+	conn.SetReadDeadline(time.Now().Add(daemonTimeout))
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		log.Errorf("daemon: unable to read request %s", err.Error())
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	response := d.handle(request)
+
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		log.Errorf("daemon: unable to answer '%s' request %s", request.Type, err.Error())
+	}
+}
+
+// handle runs the hook and returns the exit code the script would have
+func (d *daemon) handle(request daemonRequest) daemonResponse {
+	env := environment(request.Environment)
+
+	log.Info("daemon: handling '" + request.Type + "' request for client " + env.clientId())
+
+	switch request.Type {
+	case "auth":
+		if len(request.Username) <= 0 || len(request.Password) <= 0 {
+			log.Errorf("daemon: unable to authenticate username or password is null")
+			return daemonResponse{ExitCode: 33}
+		}
+
+		authentication := func() int {
+			return authenticate(d.repository, env, request.Username, request.Password)
+		}
+
+		if config.Radius.DeferredAuth && len(env.Get("auth_control_file")) > 0 {
+			runDeferred(&d.tasks, env, authentication)
+			log.Info("daemon: authentication of user '" + request.Username + "' deferred")
+			return daemonResponse{ExitCode: 2}
+		}
+
+		return daemonResponse{ExitCode: authentication()}
+	case "crresponse":
+		runDeferred(&d.tasks, env, func() int {
+			return respondToChallenge(d.repository, env, request.Response)
+		})
+		return daemonResponse{ExitCode: 0}
+	case "acct":
+		if exitCode := accounting(d.repository, env, "start"); exitCode != 0 {
+			return daemonResponse{ExitCode: exitCode}
+		}
+
+		directives, err := connectConfig(d.repository, env)
+		if err != nil {
+			log.Errorf("daemon: unable to read client config %s", err.Error())
+			return daemonResponse{ExitCode: 64}
+		}
+		return daemonResponse{ExitCode: 0, Config: directives}
+	case "stop":
+		return daemonResponse{ExitCode: accounting(d.repository, env, "stop")}
+	default:
+		log.Errorf("daemon: '" + request.Type + "' request type is unknown.")
+		return daemonResponse{ExitCode: 92}
+	}
+}
+
+//code 4
+func forwardHook(executionType string) (int, bool) {
+	// Anything the daemon cannot be asked for is left to the hook itself,
+	// which reports the error with its usual exit code
+	request := daemonRequest{Type: executionType, Environment: processEnvironment()}
+
+	switch executionType {
+	case "auth", "crresponse":
+		if len(os.Args) <= 2 {
+			return 0, false
+		}
+
+		content, err := ioutil.ReadFile(os.Args[2])
+		if err != nil {
+			return 0, false
+		}
+
+		if executionType == "auth" {
+			lines := strings.Split(string(content), "\n")
+			if len(lines) < 2 {
+				return 0, false
+			}
+			request.Username, request.Password = lines[0], lines[1]
+		} else {
+			request.Response = string(content)
+		}
+	case "acct", "stop":
+	default:
+		return 0, false
+	}
+
+	conn, err := net.DialTimeout("unix", config.Daemon.Socket, daemonTimeout)
+	if err != nil {
+		log.Warnf("forwardHook: daemon is not reachable, running '%s' locally: %s", executionType, err.Error())
+		return 0, false
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2*radiusDeadline() + daemonTimeout))
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		log.Errorf("forwardHook: unable to send request %s", err.Error())
+		return 40, true
+	}
+
+	var response daemonResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		log.Errorf("forwardHook: unable to read response %s", err.Error())
+		return 41, true
+	}
+
+	if executionType == "acct" && response.ExitCode == 0 && len(os.Args) > 2 {
+		if err := writeClientConfig(os.Args[2], response.Config); err != nil {
+			log.Errorf("forwardHook: unable to write client config %s", err.Error())
+			return 64, true
+		}
+	}
+
+	log.Infof("forwardHook: daemon finished '%s' with code %d", executionType, response.ExitCode)
+	return response.ExitCode, true
+}
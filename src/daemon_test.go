@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDaemonForwardHook(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	socket := config.Daemon.Socket
+	config.Daemon.Socket = filepath.Join(t.TempDir(), "ovpn-radius.sock")
+	defer func() { config.Daemon.Socket = socket }()
+
+	// Without a daemon the hook runs locally
+	if _, ok := forwardHook("acct"); ok {
+		t.Fatalf("Hook must not be forwarded without a listening daemon")
+	}
+
+	listener, err := listenDaemon(config.Daemon.Socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	d := &daemon{repository: repository}
+	go d.serve(listener)
+
+	if _, err := listenDaemon(config.Daemon.Socket); err != ErrDaemonRunning {
+		t.Fatalf("Expected ErrDaemonRunning, got: %v", err)
+	}
+
+	// The client has no session so the daemon answers with the accounting error
+	exitCode, ok := forwardHook("acct")
+	if !ok || exitCode != 60 {
+		t.Fatalf("Expected forwarded exit code 60, got %d (forwarded %v)", exitCode, ok)
+	}
+
+	if _, ok := forwardHook("interim"); ok {
+		t.Fatalf("Only hooks are forwarded to the daemon")
+	}
+
+	if response := d.handle(daemonRequest{Type: "unknown"}); response.ExitCode != 92 {
+		t.Fatalf("Expected exit code 92 for unknown requests, got %d", response.ExitCode)
+	}
+
+	listener.Close()
+	d.tasks.Wait()
+}
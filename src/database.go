@@ -12,21 +12,113 @@ import (
 )
 
 type OVPNClient struct {
-	Id         string
-	CommonName string
-	IpAddress  string
-	ClassName  string
+	Id              string
+	CommonName      string
+	IpAddress       string
+	ClassName       string
+	SessionId       string
+	MultiSessionId  string
+	InterimInterval int
+	StartedAt       int64
+	LastInterimAt   int64
+	SessionTimeout  int // seconds after StartedAt, 0 for no limit
+	FramedIPAddress string
+	FramedIPNetmask string
+	FramedRoutes    string // CIDR prefixes separated by spaces
+	IdleTimeout     int
+	LastActivityAt  int64
+	TerminateCause  uint32 // Acct-Terminate-Cause recorded before the session is killed
+	// TerminationAction and State of the Access-Accept, for re-authorization
+	TerminationAction uint32
+	StateName         string
+	// AccountingAttributes are the configured attributes expanded at Start,
+	// encoded as a packet, for the accounting requests of the session
+	AccountingAttributes []byte
+	NASPort              int
+	Ipv6Address          string
+	// FramedIPv6Address carries a prefix length when taken from
+	// Framed-IPv6-Prefix. FramedInterfaceId is kept as hex when the
+	// Access-Accept has no prefix to place it in
+	FramedIPv6Address string
+	FramedInterfaceId string
+	// AccessAttributes are the configured attributes of the Access-Request,
+	// encoded as a packet, for the re-authorization of the session
+	AccessAttributes []byte
+}
+
+// ServerState is the health of a RADIUS server shared between plugin invocations
+type ServerState struct {
+	Purpose   string
+	Server    string
+	Failures  int
+	DeadUntil int64
+	LastUsed  int64
+}
+
+// Challenge is a pending Access-Challenge waiting for the client response
+type Challenge struct {
+	Id           string
+	Username     string
+	State        []byte
+	ReplyMessage string
+	CreatedAt    int64
+}
+
+// QueuedAccounting is an Accounting-Request no accounting server answered,
+// waiting to be sent again
+type QueuedAccounting struct {
+	Id            int64
+	SessionId     string
+	Packet        []byte // the request as first sent, without Acct-Delay-Time
+	CreatedAt     int64
+	Attempts      int
+	NextAttemptAt int64
 }
 
 type SQLiteRepository struct {
-	db       *sql.DB
+	db *sql.DB
+	// lock keeps the goroutines of this process out of each other's critical
+	// sections, lockFile the other processes
+	lock     sync.Mutex
 	lockFile *os.File
-	mutex    sync.Mutex
 }
 
 const databaseFile string = "/etc/openvpn/plugin/db/ovpn-radius.db"
 const lockFile string = "/etc/openvpn/plugin/db/ovpn-radius.db.lock"
 
+// clientColumns lists the OVPNClients columns in OVPNClient field order
+const clientColumns string = "id, common_name, ip_address, class_name, session_id, multi_session_id, interim_interval, started_at, last_interim_at, session_timeout, framed_ip_address, framed_ip_netmask, framed_routes, idle_timeout, last_activity_at, terminate_cause, termination_action, state_name, accounting_attributes, nas_port, ipv6_address, framed_ipv6_address, framed_interface_id, access_attributes"
+
+// columnMigration adds a column introduced after the initial schema
+type columnMigration struct {
+	table      string
+	column     string
+	definition string
+}
+
+var columnMigrations = []columnMigration{
+	{"OVPNClients", "session_id", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "multi_session_id", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "interim_interval", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "started_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "last_interim_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "session_timeout", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "framed_ip_address", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "framed_ip_netmask", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "framed_routes", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "idle_timeout", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "last_activity_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "terminate_cause", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "termination_action", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "state_name", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "accounting_attributes", "BLOB NULL"},
+	{"OVPNClients", "nas_port", "INTEGER NOT NULL DEFAULT 0"},
+	{"OVPNClients", "ipv6_address", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "framed_ipv6_address", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "framed_interface_id", "TEXT NOT NULL DEFAULT ''"},
+	{"OVPNClients", "access_attributes", "BLOB NULL"},
+}
+
 var (
 	ErrDuplicate    = errors.New("record already exists")
 	ErrNotExists    = errors.New("row not exists")
@@ -40,18 +132,15 @@ func NewSQLiteRepository(db *sql.DB) *SQLiteRepository {
 	}
 }
 
-// acquireLock acquires a file-based lock for database operations
+// acquireLock acquires a file-based lock for database operations. It is held
+// by one goroutine at a time until releaseLock
 func (r *SQLiteRepository) acquireLock() error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	if r.lockFile != nil {
-		return nil // Already locked
-	}
+	r.lock.Lock()
 
 	// Create lock file
 	file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
+		r.lock.Unlock()
 		return err
 	}
 
@@ -65,24 +154,21 @@ func (r *SQLiteRepository) acquireLock() error {
 	case err := <-done:
 		if err != nil {
 			file.Close()
+			r.lock.Unlock()
 			return err
 		}
 		r.lockFile = file
 		return nil
 	case <-time.After(10 * time.Second): // 10 second timeout
 		file.Close()
+		r.lock.Unlock()
 		return errors.New("timeout acquiring database lock")
 	}
 }
 
-// releaseLock releases the file-based lock
+// releaseLock releases the lock taken by acquireLock
 func (r *SQLiteRepository) releaseLock() error {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	if r.lockFile == nil {
-		return nil // Not locked
-	}
+	defer r.lock.Unlock()
 
 	err := syscall.Flock(int(r.lockFile.Fd()), syscall.LOCK_UN)
 	r.lockFile.Close()
@@ -90,11 +176,11 @@ func (r *SQLiteRepository) releaseLock() error {
 	return err
 }
 
-// Close closes the database connection and releases any locks
+// Close closes the database connection once no operation holds the lock
 func (r *SQLiteRepository) Close() error {
-	if err := r.releaseLock(); err != nil {
-		// Log the error but continue with closing the database
-	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	return r.db.Close()
 }
 
@@ -106,10 +192,85 @@ func (r *SQLiteRepository) Migrate() error {
         ip_address TEXT NULL,
         class_name TEXT NULL
     );
+    CREATE TABLE IF NOT EXISTS RadiusServers(
+        purpose TEXT NOT NULL,
+        server TEXT NOT NULL,
+        failures INTEGER NOT NULL DEFAULT 0,
+        dead_until INTEGER NOT NULL DEFAULT 0,
+        last_used INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY(purpose, server)
+    );
+    CREATE TABLE IF NOT EXISTS Challenges(
+        id TEXT NOT NULL UNIQUE,
+        username TEXT NOT NULL,
+        state BLOB NULL,
+        reply_message TEXT NOT NULL DEFAULT '',
+        created_at INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS NASPorts(
+        port INTEGER PRIMARY KEY,
+        client_id TEXT NOT NULL UNIQUE,
+        reserved_at INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS AccountingQueue(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        session_id TEXT NOT NULL,
+        packet BLOB NOT NULL,
+        created_at INTEGER NOT NULL,
+        attempts INTEGER NOT NULL DEFAULT 0,
+        next_attempt_at INTEGER NOT NULL DEFAULT 0
+    );
     `
 
-	_, err := r.db.Exec(query)
-	return err
+	if _, err := r.db.Exec(query); err != nil {
+		return err
+	}
+
+	for _, migration := range columnMigrations {
+		exists, err := r.columnExists(migration.table, migration.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := r.db.Exec("ALTER TABLE " + migration.table + " ADD COLUMN " + migration.column + " " + migration.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) columnExists(table string, column string) (bool, error) {
+	rows, err := r.db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanClient(row rowScanner) (*OVPNClient, error) {
+	var client OVPNClient
+	if err := row.Scan(&client.Id, &client.CommonName, &client.IpAddress, &client.ClassName, &client.SessionId, &client.MultiSessionId, &client.InterimInterval, &client.StartedAt, &client.LastInterimAt, &client.SessionTimeout, &client.FramedIPAddress, &client.FramedIPNetmask, &client.FramedRoutes, &client.IdleTimeout, &client.LastActivityAt, &client.TerminateCause, &client.TerminationAction, &client.StateName, &client.AccountingAttributes, &client.NASPort, &client.Ipv6Address, &client.FramedIPv6Address, &client.FramedInterfaceId, &client.AccessAttributes); err != nil {
+		return nil, err
+	}
+	return &client, nil
 }
 
 func (r *SQLiteRepository) Create(client OVPNClient) (*OVPNClient, error) {
@@ -118,7 +279,7 @@ func (r *SQLiteRepository) Create(client OVPNClient) (*OVPNClient, error) {
 	}
 	defer r.releaseLock()
 
-	_, err := r.db.Exec("INSERT INTO OVPNClients(id, common_name, ip_address, class_name) values(?,?,?,?)", client.Id, client.CommonName, client.IpAddress, client.ClassName)
+	_, err := r.db.Exec("INSERT INTO OVPNClients("+clientColumns+") values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)", client.Id, client.CommonName, client.IpAddress, client.ClassName, client.SessionId, client.MultiSessionId, client.InterimInterval, client.StartedAt, client.LastInterimAt, client.SessionTimeout, client.FramedIPAddress, client.FramedIPNetmask, client.FramedRoutes, client.IdleTimeout, client.LastActivityAt, client.TerminateCause, client.TerminationAction, client.StateName, client.AccountingAttributes, client.NASPort, client.Ipv6Address, client.FramedIPv6Address, client.FramedInterfaceId, client.AccessAttributes)
 
 	if err != nil {
 		var sqliteErr sqlite3.Error
@@ -134,7 +295,7 @@ func (r *SQLiteRepository) Create(client OVPNClient) (*OVPNClient, error) {
 }
 
 func (r *SQLiteRepository) All() ([]OVPNClient, error) {
-	rows, err := r.db.Query("SELECT * FROM OVPNClients")
+	rows, err := r.db.Query("SELECT " + clientColumns + " FROM OVPNClients")
 	if err != nil {
 		return nil, err
 	}
@@ -142,26 +303,26 @@ func (r *SQLiteRepository) All() ([]OVPNClient, error) {
 
 	var all []OVPNClient
 	for rows.Next() {
-		var client OVPNClient
-		if err := rows.Scan(&client.Id, &client.CommonName, &client.IpAddress, &client.ClassName); err != nil {
+		client, err := scanClient(rows)
+		if err != nil {
 			return nil, err
 		}
-		all = append(all, client)
+		all = append(all, *client)
 	}
 	return all, nil
 }
 
 func (r *SQLiteRepository) GetById(id string) (*OVPNClient, error) {
-	row := r.db.QueryRow("SELECT * FROM OVPNClients WHERE id = ?", id)
+	row := r.db.QueryRow("SELECT "+clientColumns+" FROM OVPNClients WHERE id = ?", id)
 
-	var client OVPNClient
-	if err := row.Scan(&client.Id, &client.CommonName, &client.IpAddress, &client.ClassName); err != nil {
+	client, err := scanClient(row)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotExists
 		}
 		return nil, err
 	}
-	return &client, nil
+	return client, nil
 }
 
 func (r *SQLiteRepository) Update(client OVPNClient) (*OVPNClient, error) {
@@ -174,7 +335,7 @@ func (r *SQLiteRepository) Update(client OVPNClient) (*OVPNClient, error) {
 	}
 	defer r.releaseLock()
 
-	res, err := r.db.Exec("UPDATE OVPNClients SET common_name = ?, ip_address = ?, class_name = ? WHERE id = ?", client.CommonName, client.IpAddress, client.ClassName, client.Id)
+	res, err := r.db.Exec("UPDATE OVPNClients SET common_name = ?, ip_address = ?, class_name = ?, session_id = ?, multi_session_id = ?, interim_interval = ?, started_at = ?, last_interim_at = ?, session_timeout = ?, framed_ip_address = ?, framed_ip_netmask = ?, framed_routes = ?, idle_timeout = ?, last_activity_at = ?, terminate_cause = ?, termination_action = ?, state_name = ?, accounting_attributes = ?, nas_port = ?, ipv6_address = ?, framed_ipv6_address = ?, framed_interface_id = ?, access_attributes = ? WHERE id = ?", client.CommonName, client.IpAddress, client.ClassName, client.SessionId, client.MultiSessionId, client.InterimInterval, client.StartedAt, client.LastInterimAt, client.SessionTimeout, client.FramedIPAddress, client.FramedIPNetmask, client.FramedRoutes, client.IdleTimeout, client.LastActivityAt, client.TerminateCause, client.TerminationAction, client.StateName, client.AccountingAttributes, client.NASPort, client.Ipv6Address, client.FramedIPv6Address, client.FramedInterfaceId, client.AccessAttributes, client.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -191,6 +352,106 @@ func (r *SQLiteRepository) Update(client OVPNClient) (*OVPNClient, error) {
 	return &client, nil
 }
 
+// SetLastInterim records the time of the last Interim-Update without touching
+// columns that hooks may have changed in the meantime
+func (r *SQLiteRepository) SetLastInterim(id string, lastInterimAt int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	res, err := r.db.Exec("UPDATE OVPNClients SET last_interim_at = ? WHERE id = ?", lastInterimAt, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// SetLastActivity records when the client last sent or received tunnel traffic
+func (r *SQLiteRepository) SetLastActivity(id string, lastActivityAt int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	res, err := r.db.Exec("UPDATE OVPNClients SET last_activity_at = ? WHERE id = ?", lastActivityAt, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// SetTerminateCause records the Acct-Terminate-Cause the Stop of a session
+// will carry
+func (r *SQLiteRepository) SetTerminateCause(id string, cause uint32) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	res, err := r.db.Exec("UPDATE OVPNClients SET terminate_cause = ? WHERE id = ?", cause, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
+// SetAuthorization stores the Class, Acct-Interim-Interval, Session-Timeout,
+// Termination-Action and State changed by a CoA-Request or re-authorization
+// without touching the other columns
+func (r *SQLiteRepository) SetAuthorization(client OVPNClient) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	res, err := r.db.Exec("UPDATE OVPNClients SET class_name = ?, interim_interval = ?, session_timeout = ?, idle_timeout = ?, termination_action = ?, state_name = ? WHERE id = ?", client.ClassName, client.InterimInterval, client.SessionTimeout, client.IdleTimeout, client.TerminationAction, client.StateName, client.Id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrUpdateFailed
+	}
+
+	return nil
+}
+
 func (r *SQLiteRepository) Delete(id string) error {
 	if err := r.acquireLock(); err != nil {
 		return err
@@ -202,6 +463,11 @@ func (r *SQLiteRepository) Delete(id string) error {
 		return err
 	}
 
+	// The NAS-Port of the session is free again
+	if _, err := r.db.Exec("DELETE FROM NASPorts WHERE client_id = ?", id); err != nil {
+		return err
+	}
+
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
 		return err
@@ -214,6 +480,237 @@ func (r *SQLiteRepository) Delete(id string) error {
 	return err
 }
 
+func (r *SQLiteRepository) ServerStates(purpose string) (map[string]ServerState, error) {
+	rows, err := r.db.Query("SELECT purpose, server, failures, dead_until, last_used FROM RadiusServers WHERE purpose = ?", purpose)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]ServerState)
+	for rows.Next() {
+		var state ServerState
+		if err := rows.Scan(&state.Purpose, &state.Server, &state.Failures, &state.DeadUntil, &state.LastUsed); err != nil {
+			return nil, err
+		}
+		states[state.Server] = state
+	}
+	return states, rows.Err()
+}
+
+func (r *SQLiteRepository) MarkServerUsed(purpose string, server string, now int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("INSERT INTO RadiusServers(purpose, server, last_used) values(?,?,?) ON CONFLICT(purpose, server) DO UPDATE SET last_used = excluded.last_used", purpose, server, now)
+	return err
+}
+
+func (r *SQLiteRepository) RecordServerSuccess(purpose string, server string) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("INSERT INTO RadiusServers(purpose, server) values(?,?) ON CONFLICT(purpose, server) DO UPDATE SET failures = 0, dead_until = 0", purpose, server)
+	return err
+}
+
+// RecordServerFailure counts a timeout and marks the server dead until
+// deadUntil once deadAfter consecutive timeouts were seen. It reports whether
+// the server was marked dead by this call
+func (r *SQLiteRepository) RecordServerFailure(purpose string, server string, deadAfter int, deadUntil int64) (bool, error) {
+	if err := r.acquireLock(); err != nil {
+		return false, err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("INSERT INTO RadiusServers(purpose, server, failures) values(?,?,1) ON CONFLICT(purpose, server) DO UPDATE SET failures = failures + 1", purpose, server)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := r.db.Exec("UPDATE RadiusServers SET failures = 0, dead_until = ? WHERE purpose = ? AND server = ? AND failures >= ?", deadUntil, purpose, server, deadAfter)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// CreateChallenge stores a challenge and drops the ones older than expiredBefore
+func (r *SQLiteRepository) CreateChallenge(challenge Challenge, expiredBefore int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	if _, err := r.db.Exec("DELETE FROM Challenges WHERE created_at < ?", expiredBefore); err != nil {
+		return err
+	}
+
+	_, err := r.db.Exec("INSERT INTO Challenges(id, username, state, reply_message, created_at) values(?,?,?,?,?)", challenge.Id, challenge.Username, challenge.State, challenge.ReplyMessage, challenge.CreatedAt)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			if errors.Is(sqliteErr.ExtendedCode, sqlite3.ErrConstraintUnique) {
+				return ErrDuplicate
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (r *SQLiteRepository) GetChallenge(id string) (*Challenge, error) {
+	row := r.db.QueryRow("SELECT id, username, state, reply_message, created_at FROM Challenges WHERE id = ?", id)
+
+	var challenge Challenge
+	if err := row.Scan(&challenge.Id, &challenge.Username, &challenge.State, &challenge.ReplyMessage, &challenge.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotExists
+		}
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (r *SQLiteRepository) DeleteChallenge(id string) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("DELETE FROM Challenges WHERE id = ?", id)
+	return err
+}
+
+// AllocateNASPort returns the NAS-Port reserved for the client, reserving the
+// lowest free port for a new client. Reservations made before expiredBefore
+// of clients that never got a session are released first
+func (r *SQLiteRepository) AllocateNASPort(clientId string, now int64, expiredBefore int64) (int, error) {
+	if err := r.acquireLock(); err != nil {
+		return 0, err
+	}
+	defer r.releaseLock()
+
+	if _, err := r.db.Exec("DELETE FROM NASPorts WHERE reserved_at < ? AND client_id NOT IN (SELECT id FROM OVPNClients)", expiredBefore); err != nil {
+		return 0, err
+	}
+
+	// The lowest free port is picked and reserved in one statement, since the
+	// daemon and the plugin allocate from concurrent goroutines. A client
+	// that already has a port keeps it
+	query := "INSERT OR IGNORE INTO NASPorts(port, client_id, reserved_at) SELECT MIN(port + 1), ?, ? FROM (SELECT 0 AS port UNION ALL SELECT port FROM NASPorts) WHERE port + 1 NOT IN (SELECT port FROM NASPorts)"
+	if _, err := r.db.Exec(query, clientId, now); err != nil {
+		return 0, err
+	}
+
+	var port int
+	if err := r.db.QueryRow("SELECT port FROM NASPorts WHERE client_id = ?", clientId).Scan(&port); err != nil {
+		return 0, err
+	}
+
+	return port, nil
+}
+
+// ReleaseNASPort frees the NAS-Port reserved for a client without a session
+func (r *SQLiteRepository) ReleaseNASPort(clientId string) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("DELETE FROM NASPorts WHERE client_id = ? AND client_id NOT IN (SELECT id FROM OVPNClients)", clientId)
+	return err
+}
+
+func (r *SQLiteRepository) QueueAccounting(entry QueuedAccounting) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("INSERT INTO AccountingQueue(session_id, packet, created_at, attempts, next_attempt_at) values(?,?,?,?,?)", entry.SessionId, entry.Packet, entry.CreatedAt, entry.Attempts, entry.NextAttemptAt)
+	return err
+}
+
+// QueuedAccounting returns the queued requests in the order they were queued
+func (r *SQLiteRepository) QueuedAccounting() ([]QueuedAccounting, error) {
+	rows, err := r.db.Query("SELECT id, session_id, packet, created_at, attempts, next_attempt_at FROM AccountingQueue ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []QueuedAccounting
+	for rows.Next() {
+		var entry QueuedAccounting
+		if err := rows.Scan(&entry.Id, &entry.SessionId, &entry.Packet, &entry.CreatedAt, &entry.Attempts, &entry.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		all = append(all, entry)
+	}
+	return all, rows.Err()
+}
+
+func (r *SQLiteRepository) HasQueuedAccounting(sessionId string) (bool, error) {
+	var count int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM AccountingQueue WHERE session_id = ?", sessionId).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ClaimQueuedAccounting moves the next attempt of a due request to leaseUntil
+// so that concurrent flushes do not send it twice. It reports false when the
+// request is gone or not due
+func (r *SQLiteRepository) ClaimQueuedAccounting(id int64, now int64, leaseUntil int64) (bool, error) {
+	if err := r.acquireLock(); err != nil {
+		return false, err
+	}
+	defer r.releaseLock()
+
+	res, err := r.db.Exec("UPDATE AccountingQueue SET next_attempt_at = ? WHERE id = ? AND next_attempt_at <= ?", leaseUntil, id, now)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func (r *SQLiteRepository) RetryQueuedAccounting(id int64, attempts int, nextAttemptAt int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("UPDATE AccountingQueue SET attempts = ?, next_attempt_at = ? WHERE id = ?", attempts, nextAttemptAt, id)
+	return err
+}
+
+func (r *SQLiteRepository) DeleteQueuedAccounting(id int64) error {
+	if err := r.acquireLock(); err != nil {
+		return err
+	}
+	defer r.releaseLock()
+
+	_, err := r.db.Exec("DELETE FROM AccountingQueue WHERE id = ?", id)
+	return err
+}
+
 func InitializeDatabase(isNewDatabase bool) (*SQLiteRepository, error) {
 	if isNewDatabase {
 		os.Remove(databaseFile)
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"testing"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func TestDatabaseLogic(t *testing.T) {
@@ -106,4 +110,180 @@ func TestDatabaseLogic(t *testing.T) {
 	}
 
 	t.Logf("All database logic tests passed successfully")
-}
\ No newline at end of file
+}
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	os.Remove(databaseFile)
+
+	// Create a database with the schema used before session ids were stored
+	db, err := sql.Open("sqlite3", databaseFile)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE OVPNClients(id TEXT NOT NULL UNIQUE, common_name TEXT NOT NULL, ip_address TEXT NULL, class_name TEXT NULL);
+		INSERT INTO OVPNClients(id, common_name, ip_address, class_name) values('192.168.1.3:1111', 'olduser', '', '')`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	repository, err := InitializeDatabase(false)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	defer repository.Close()
+
+	client, err := repository.GetById("192.168.1.3:1111")
+	if err != nil {
+		t.Fatalf("Failed to read migrated client: %v", err)
+	}
+	if client.SessionId != "" {
+		t.Fatalf("Expected empty session id after migration, got %s", client.SessionId)
+	}
+
+	sessionId, err := newSessionId()
+	if err != nil {
+		t.Fatalf("Failed to generate session id: %v", err)
+	}
+	client.SessionId = sessionId
+	if _, err := repository.Update(*client); err != nil {
+		t.Fatalf("Failed to update session id: %v", err)
+	}
+
+	updated, _ := repository.GetById(client.Id)
+	if updated.SessionId != sessionId {
+		t.Fatalf("Session id not stored: got %s, want %s", updated.SessionId, sessionId)
+	}
+}
+
+func TestSessionIdUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		sessionId, err := newSessionId()
+		if err != nil {
+			t.Fatalf("Failed to generate session id: %v", err)
+		}
+		if seen[sessionId] {
+			t.Fatalf("Duplicate session id %s", sessionId)
+		}
+		seen[sessionId] = true
+	}
+}
+
+func TestNASPortAllocation(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	allocate := func(clientId string, now int64) int {
+		t.Helper()
+		port, err := repository.AllocateNASPort(clientId, now, now-nasPortReservationLifetime)
+		if err != nil {
+			t.Fatalf("Failed to allocate NAS-Port: %v", err)
+		}
+		return port
+	}
+
+	now := time.Now().Unix()
+	for index, clientId := range []string{"192.0.2.1:1000", "192.0.2.2:1000", "192.0.2.3:1000"} {
+		if port := allocate(clientId, now); port != index+1 {
+			t.Fatalf("Expected NAS-Port %d for %s, got %d", index+1, clientId, port)
+		}
+		repository.Create(OVPNClient{Id: clientId, CommonName: clientId, NASPort: index + 1})
+	}
+
+	// Re-authentication of a session keeps its port
+	if port := allocate("192.0.2.2:1000", now); port != 2 {
+		t.Fatalf("Expected the session to keep NAS-Port 2, got %d", port)
+	}
+
+	// The port of a stopped session is handed out again
+	if err := repository.Delete("192.0.2.2:1000"); err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if port := allocate("192.0.2.4:1000", now); port != 2 {
+		t.Fatalf("Expected the freed NAS-Port 2, got %d", port)
+	}
+
+	// A rejected client gives its reservation back
+	if err := repository.ReleaseNASPort("192.0.2.4:1000"); err != nil {
+		t.Fatalf("Failed to release NAS-Port: %v", err)
+	}
+	if err := repository.ReleaseNASPort("192.0.2.1:1000"); err != nil {
+		t.Fatalf("Failed to release NAS-Port: %v", err)
+	}
+	if port := allocate("192.0.2.5:1000", now); port != 2 {
+		t.Fatalf("Expected the released NAS-Port 2, got %d", port)
+	}
+	if port := allocate("192.0.2.1:1000", now); port != 1 {
+		t.Fatalf("Release must not free the port of a session, got %d", port)
+	}
+
+	// Reservations that never became a session expire
+	if port := allocate("192.0.2.6:1000", now+nasPortReservationLifetime+1); port != 2 {
+		t.Fatalf("Expected the expired NAS-Port 2, got %d", port)
+	}
+
+	// Concurrent authentications in one process get distinct ports
+	var wait sync.WaitGroup
+	ports := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			port, err := repository.AllocateNASPort("198.51.100.1:"+strconv.Itoa(i), now, now-nasPortReservationLifetime)
+			if err != nil {
+				t.Errorf("Failed to allocate NAS-Port: %v", err)
+			}
+			ports <- port
+		}(i)
+	}
+	wait.Wait()
+	close(ports)
+
+	seen := make(map[int]bool)
+	for port := range ports {
+		if seen[port] {
+			t.Fatalf("NAS-Port %d was allocated twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+func TestRepositoryLock(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	if err := repository.acquireLock(); err != nil {
+		t.Fatalf("Failed to acquire lock: %v", err)
+	}
+
+	// Another goroutine waits until the holder releases the lock
+	acquired := make(chan struct{})
+	go func() {
+		if err := repository.acquireLock(); err != nil {
+			t.Errorf("Failed to acquire lock: %v", err)
+		}
+		close(acquired)
+		repository.releaseLock()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("The lock must not be shared between goroutines")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	repository.releaseLock()
+
+	select {
+	case <-acquired:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the released lock")
+	}
+}
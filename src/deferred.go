@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deferredAuth tells whether authentications may finish after the hook
+// returned, which the native plugin and the management mode always do
+func deferredAuth() bool {
+	return nativePlugin || managementMode || config.Radius.DeferredAuth
+}
+
+// deferAuthentication starts a detached "auth-worker" process that finishes
+// the authentication in the background. The credentials are passed on stdin
+// because OpenVPN removes the via-file once the hook returns
+func deferAuthentication(username string, password string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, "auth-worker")
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+// runDeferred finishes an authentication in the background of a long-lived
+// process and reports its result through auth_control_file. The hook has
+// returned by then, so a challenge cannot use the auth_pending_file of env
+func runDeferred(tasks *sync.WaitGroup, env environment, authentication func() int) {
+	afterHook(env)
+
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+
+		exitCode := authentication()
+		if err := writeAuthControlFile(env, exitCode); err != nil {
+			log.Errorf("runDeferred: unable to write auth_control_file %s", err.Error())
+			return
+		}
+
+		log.Infof("runDeferred: authentication finished with code %d", exitCode)
+	}()
+}
+
+// deferredConnect is a client-connect running in the background of the
+// plugin, until OpenVPN collects its result
+type deferredConnect struct {
+	done       bool
+	exitCode   int
+	directives []string
+}
+
+// deferredConnects tracks the deferred client-connects by client id
+type deferredConnects struct {
+	mutex    sync.Mutex
+	connects map[string]*deferredConnect
+}
+
+// start runs the client-connect in the background
+func (d *deferredConnects) start(tasks *sync.WaitGroup, id string, connect func() (int, []string)) {
+	d.mutex.Lock()
+	if d.connects == nil {
+		d.connects = make(map[string]*deferredConnect)
+	}
+	d.connects[id] = &deferredConnect{}
+	d.mutex.Unlock()
+
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+
+		exitCode, directives := connect()
+
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if pending, ok := d.connects[id]; ok {
+			pending.done, pending.exitCode, pending.directives = true, exitCode, directives
+		}
+
+		log.Infof("deferredConnects: client-connect of %s finished with code %d", id, exitCode)
+	}()
+}
+
+// result returns the finished client-connect of the client and forgets it.
+// It returns false while the client-connect is still running, a client
+// without client-connect fails
+func (d *deferredConnects) result(id string) (*deferredConnect, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	pending, ok := d.connects[id]
+	if !ok {
+		return &deferredConnect{done: true, exitCode: 60}, true
+	}
+	if !pending.done {
+		return nil, false
+	}
+
+	delete(d.connects, id)
+	return pending, true
+}
+
+// forget drops the client-connect of a client that is gone
+func (d *deferredConnects) forget(id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.connects, id)
+}
+
+// clientConnect sends the accounting Start of the connecting client and
+// returns the exit code with the client-connect directives of the session
+func clientConnect(repository *SQLiteRepository, env environment) (int, []string) {
+	if exitCode := accounting(repository, env, "start"); exitCode != 0 {
+		return exitCode, nil
+	}
+
+	directives, err := connectConfig(repository, env)
+	if err != nil {
+		log.Errorf("clientConnect: unable to read client config %s", err.Error())
+		return 64, nil
+	}
+
+	return 0, directives
+}
+
+// writeAuthControlFile reports the result of a deferred authentication to
+// OpenVPN. Pending results leave the file untouched until the client answers
+func writeAuthControlFile(env environment, exitCode int) error {
+	path := env.Get("auth_control_file")
+	if len(path) == 0 {
+		return errors.New("auth_control_file is not set")
+	}
+
+	switch exitCode {
+	case 0:
+		return ioutil.WriteFile(path, []byte("1"), 0600)
+	case 2:
+		return nil
+	default:
+		return ioutil.WriteFile(path, []byte("0"), 0600)
+	}
+}
+
+//code 7
+func authenticationWorker(repository *SQLiteRepository) {
+	env := afterHook(processEnvironment())
+	reader := bufio.NewReader(os.Stdin)
+
+	username, errUsername := reader.ReadString('\n')
+	password, errPassword := reader.ReadString('\n')
+	if errUsername != nil || errPassword != nil {
+		log.Errorf("authenticationWorker: unable to read credentials")
+		writeAuthControlFile(env, 70)
+		os.Exit(70)
+	}
+
+	exitCode := authenticate(repository, env, strings.TrimSuffix(username, "\n"), strings.TrimSuffix(password, "\n"))
+
+	if err := writeAuthControlFile(env, exitCode); err != nil {
+		log.Errorf("authenticationWorker: unable to write auth_control_file %s", err.Error())
+		os.Exit(71)
+	}
+
+	log.Infof("authenticationWorker: authentication finished with code %d", exitCode)
+	os.Exit(0)
+}
+
+//code 8
+func challengeResponse(repository *SQLiteRepository) {
+	if len(os.Args) <= 2 {
+		log.Errorf("challengeResponse: 'null' file path.")
+		os.Exit(80)
+	}
+
+	responseFile, err := ioutil.ReadFile(os.Args[2])
+	if err != nil {
+		log.Errorf("challengeResponse: failed with %s\n", err)
+		os.Exit(81)
+	}
+
+	env := processEnvironment()
+	exitCode := respondToChallenge(repository, env, string(responseFile))
+
+	if err := writeAuthControlFile(env, exitCode); err != nil {
+		log.Errorf("challengeResponse: unable to write auth_control_file %s", err.Error())
+		os.Exit(83)
+	}
+
+	log.Infof("challengeResponse: authentication finished with code %d", exitCode)
+	os.Exit(0)
+}
+
+// respondToChallenge answers the pending challenge of the client with its
+// base64 encoded response and returns the exit code reported to OpenVPN
+func respondToChallenge(repository *SQLiteRepository, env environment, encodedResponse string) int {
+	response, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedResponse))
+	if err != nil {
+		log.Errorf("challengeResponse: malformed response %s\n", err)
+		return 82
+	}
+
+	username := env.Get("username")
+	if len(username) == 0 {
+		username = env.Get("common_name")
+	}
+
+	// Pending challenges are stored under the client id and answered like a CRV1 response
+	stateId := pendingChallengeId(env.clientId())
+	return authenticate(repository, env, username, dynamicChallengePrefix+stateId+"::"+string(response))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestDeferredConnects(t *testing.T) {
+	var connects deferredConnects
+	var tasks sync.WaitGroup
+
+	release := make(chan struct{})
+	connects.start(&tasks, "192.0.2.10:50000", func() (int, []string) {
+		<-release
+		return 0, []string{"inactive 300"}
+	})
+
+	if _, done := connects.result("192.0.2.10:50000"); done {
+		t.Fatalf("The client-connect must still be running")
+	}
+
+	close(release)
+	tasks.Wait()
+
+	connect, done := connects.result("192.0.2.10:50000")
+	if !done || connect.exitCode != 0 || len(connect.directives) != 1 || connect.directives[0] != "inactive 300" {
+		t.Fatalf("Unexpected client-connect result %+v", connect)
+	}
+
+	// The result is collected once, an unknown client fails
+	if connect, done := connects.result("192.0.2.10:50000"); !done || connect.exitCode == 0 {
+		t.Fatalf("Expected a failed client-connect, got %+v", connect)
+	}
+
+	// A client that disconnected before its result was collected is forgotten
+	connects.start(&tasks, "192.0.2.11:50000", func() (int, []string) { return 0, nil })
+	connects.forget("192.0.2.11:50000")
+	tasks.Wait()
+	if connect, _ := connects.result("192.0.2.11:50000"); connect.exitCode == 0 {
+		t.Fatalf("Expected the client-connect to be forgotten")
+	}
+}
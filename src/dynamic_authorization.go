@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDynamicAuthorizationListen = ":3799"
+
+	// Requests whose Event-Timestamp is further off are discarded as replays
+	eventTimestampWindow = 300
+
+	// Replies are kept to answer retransmissions without acting twice
+	dynamicAuthorizationReplyLifetime = 30 * time.Second
+)
+
+// disconnectAttributes are the attributes understood in a Disconnect-Request
+var disconnectAttributes = map[AttributeType]bool{
+	AttrUserName:             true,
+	AttrAcctSessionId:        true,
+	AttrAcctMultiSessionId:   true,
+	AttrFramedIPAddress:      true,
+	AttrFramedIPv6Address:    true,
+	AttrNASPort:              true,
+	AttrNASPortId:            true,
+	AttrCallingStationId:     true,
+	AttrCalledStationId:      true,
+	AttrNASIdentifier:        true,
+	AttrNASIPAddress:         true,
+	AttrNASIPv6Address:       true,
+	AttrEventTimestamp:       true,
+	AttrMessageAuthenticator: true,
+	AttrProxyState:           true,
+}
+
+// coaAttributes are the attributes understood in a CoA-Request: the session
+// identification and the authorizations that can change on a live session.
+// OpenVPN takes iroute and the other client-connect directives only when the
+// client connects, so routes and filters cannot be changed
+var coaAttributes = map[AttributeType]bool{
+	AttrClass:               true,
+	AttrSessionTimeout:      true,
+	AttrIdleTimeout:         true,
+	AttrAcctInterimInterval: true,
+}
+
+// dynamicAuthorization answers Disconnect-Request and CoA-Request (RFC 5176)
+type dynamicAuthorization struct {
+	repository *SQLiteRepository
+
+	mutex   sync.Mutex
+	replies map[string]dynamicAuthorizationReply
+}
+
+type dynamicAuthorizationReply struct {
+	raw     []byte
+	expires time.Time
+}
+
+//code 11
+func runDynamicAuthorization(repository *SQLiteRepository) {
+	settings := config.Radius.DynamicAuthorization
+
+	if len(settings.Clients) == 0 {
+		log.Errorf("runDynamicAuthorization: Radius.DynamicAuthorization.Clients is not configured")
+		os.Exit(110)
+	}
+
+	if len(config.OpenVPN.Management) == 0 {
+		log.Errorf("runDynamicAuthorization: OpenVPN.Management is required to disconnect clients")
+		os.Exit(111)
+	}
+
+	conn, err := listenDynamicAuthorization()
+	if err != nil {
+		log.Errorf("runDynamicAuthorization: %s", err.Error())
+		os.Exit(112)
+	}
+	defer conn.Close()
+
+	if err := serveDynamicAuthorization(repository, conn); err != nil {
+		log.Errorf("runDynamicAuthorization: read failed with %s", err.Error())
+		os.Exit(113)
+	}
+}
+
+// listenDynamicAuthorization opens the configured Listen address
+func listenDynamicAuthorization() (net.PacketConn, error) {
+	listen := config.Radius.DynamicAuthorization.Listen
+	if len(listen) == 0 {
+		listen = defaultDynamicAuthorizationListen
+	}
+
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, errors.New("unable to listen on " + listen + ": " + err.Error())
+	}
+
+	log.Info("dynamicAuthorization: listening on " + listen)
+	return conn, nil
+}
+
+// serveDynamicAuthorization answers the requests until reading fails
+func serveDynamicAuthorization(repository *SQLiteRepository, conn net.PacketConn) error {
+	d := newDynamicAuthorization(repository)
+
+	buffer := make([]byte, maxPacketLength)
+	for {
+		n, source, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		raw := make([]byte, n)
+		copy(raw, buffer[:n])
+
+		if reply := d.respond(raw, source); reply != nil {
+			if _, err := conn.WriteTo(reply, source); err != nil {
+				log.Errorf("dynamicAuthorization: unable to reply to %s: %s", source, err.Error())
+			}
+		}
+	}
+}
+
+func newDynamicAuthorization(repository *SQLiteRepository) *dynamicAuthorization {
+	return &dynamicAuthorization{
+		repository: repository,
+		replies:    make(map[string]dynamicAuthorizationReply),
+	}
+}
+
+// dynamicAuthorizationClient returns the configured client the packet came
+// from, matching its address or network
+func dynamicAuthorizationClient(source net.Addr) *ConfigDynamicAuthorizationClient {
+	udpAddress, ok := source.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	clients := config.Radius.DynamicAuthorization.Clients
+	for i := range clients {
+		if _, network, err := net.ParseCIDR(clients[i].Address); err == nil {
+			if network.Contains(udpAddress.IP) {
+				return &clients[i]
+			}
+		} else if ip := net.ParseIP(clients[i].Address); ip != nil && ip.Equal(udpAddress.IP) {
+			return &clients[i]
+		}
+	}
+	return nil
+}
+
+// respond returns the encoded reply to a raw request, or nil when the request
+// must be silently discarded
+func (d *dynamicAuthorization) respond(raw []byte, source net.Addr) []byte {
+	client := dynamicAuthorizationClient(source)
+	if client == nil {
+		log.Warnf("dynamicAuthorization: discarding request from unknown client %s", source)
+		return nil
+	}
+
+	request, err := DecodePacket(raw)
+	if err != nil {
+		log.Warnf("dynamicAuthorization: discarding request from %s: %s", source, err.Error())
+		return nil
+	}
+
+	if err := VerifyRequest(raw, client.Secret); err != nil {
+		log.Warnf("dynamicAuthorization: discarding %s from %s: %s", request.Code, source, err.Error())
+		return nil
+	}
+
+	if _, ok := request.Get(AttrMessageAuthenticator); !ok && client.RequireMessageAuthenticator {
+		log.Warnf("dynamicAuthorization: discarding %s from %s without Message-Authenticator", request.Code, source)
+		return nil
+	}
+
+	if timestamp, ok := request.GetInteger(AttrEventTimestamp); ok {
+		if offset := time.Now().Unix() - int64(timestamp); offset > eventTimestampWindow || offset < -eventTimestampWindow {
+			log.Warnf("dynamicAuthorization: discarding %s from %s with Event-Timestamp %d seconds off", request.Code, source, offset)
+			return nil
+		}
+	}
+
+	key := source.String() + "/" + strconv.Itoa(int(request.Identifier)) + "/" + hex.EncodeToString(request.Authenticator[:])
+	if reply := d.cachedReply(key); reply != nil {
+		log.Info("dynamicAuthorization: answering retransmitted " + request.Code.String() + " from " + source.String())
+		return reply
+	}
+
+	log.Info("dynamicAuthorization: received " + request.Code.String() + " from " + source.String())
+
+	var response *Packet
+	switch request.Code {
+	case CodeDisconnectRequest:
+		response = d.disconnect(request)
+	case CodeCoARequest:
+		response = d.changeOfAuthorization(request)
+	default:
+		log.Warnf("dynamicAuthorization: discarding unexpected %s from %s", request.Code, source)
+		return nil
+	}
+
+	// Proxy-State is returned unmodified and in order (RFC 5176 section 3)
+	for _, state := range request.GetAll(AttrProxyState) {
+		response.Add(AttrProxyState, state)
+	}
+	if _, ok := request.Get(AttrMessageAuthenticator); ok {
+		response.AddMessageAuthenticator()
+	}
+
+	reply, err := response.EncodeResponse(request, client.Secret)
+	if err != nil {
+		log.Errorf("dynamicAuthorization: unable to encode %s: %s", response.Code, err.Error())
+		return nil
+	}
+
+	d.storeReply(key, reply)
+
+	log.Info("dynamicAuthorization: sent " + response.Code.String() + " to " + source.String())
+	return reply
+}
+
+func (d *dynamicAuthorization) cachedReply(key string) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for cachedKey, reply := range d.replies {
+		if now.After(reply.expires) {
+			delete(d.replies, cachedKey)
+		}
+	}
+
+	if reply, ok := d.replies[key]; ok {
+		return reply.raw
+	}
+	return nil
+}
+
+func (d *dynamicAuthorization) storeReply(key string, raw []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.replies[key] = dynamicAuthorizationReply{raw: raw, expires: time.Now().Add(dynamicAuthorizationReplyLifetime)}
+}
+
+func dynamicAuthorizationNAK(code PacketCode, errorCause uint32) *Packet {
+	response := &Packet{Code: code}
+	response.AddInteger(AttrErrorCause, errorCause)
+	return response
+}
+
+// checkNASIdentification tells whether the NAS attributes of the request, if
+// any, name this server
+func checkNASIdentification(request *Packet) bool {
+	if identifier, ok := request.GetString(AttrNASIdentifier); ok && identifier != config.ServerInfo.Identifier {
+		return false
+	}
+	if ip, ok := request.GetIPAddress(AttrNASIPAddress); ok && !ip.Equal(net.ParseIP(config.ServerInfo.IpAddress)) {
+		return false
+	}
+	if ip, ok := request.GetIPv6Address(AttrNASIPv6Address); ok && !ip.Equal(net.ParseIP(config.ServerInfo.IpAddress)) && !ip.Equal(net.ParseIP(config.ServerInfo.Ipv6Address)) {
+		return false
+	}
+	return true
+}
+
+// stationAttributes identify a session by the value its accounting requests
+// carry from Radius.Attributes
+var stationAttributes = []AttributeType{AttrNASPortId, AttrCallingStationId, AttrCalledStationId}
+
+// matchSessions returns the sessions matching every identification attribute
+// of the request. It returns false when the request identifies no session
+func matchSessions(clients []OVPNClient, request *Packet) ([]OVPNClient, bool) {
+	userName, hasUserName := request.GetString(AttrUserName)
+	sessionId, hasSessionId := request.GetString(AttrAcctSessionId)
+	multiSessionId, hasMultiSessionId := request.GetString(AttrAcctMultiSessionId)
+	framedIP, hasFramedIP := request.GetIPAddress(AttrFramedIPAddress)
+	framedIPv6, hasFramedIPv6 := request.GetIPv6Address(AttrFramedIPv6Address)
+	nasPort, hasNASPort := request.GetInteger(AttrNASPort)
+
+	stations := make(map[AttributeType][]byte)
+	for _, attributeType := range stationAttributes {
+		if value, ok := request.Get(attributeType); ok {
+			stations[attributeType] = value
+		}
+	}
+
+	if !hasUserName && !hasSessionId && !hasMultiSessionId && !hasFramedIP && !hasFramedIPv6 && !hasNASPort && len(stations) == 0 {
+		return nil, false
+	}
+
+	var sessions []OVPNClient
+	for _, client := range clients {
+		if hasUserName && client.CommonName != userName {
+			continue
+		}
+		if hasSessionId && client.SessionId != sessionId {
+			continue
+		}
+		if hasMultiSessionId && client.MultiSessionId != multiSessionId {
+			continue
+		}
+		if hasFramedIP && !framedIP.Equal(net.ParseIP(client.IpAddress)) {
+			continue
+		}
+		if hasFramedIPv6 && !framedIPv6.Equal(net.ParseIP(client.Ipv6Address)) {
+			continue
+		}
+		if hasNASPort && uint32(client.NASPort) != nasPort {
+			continue
+		}
+		if len(stations) > 0 && !matchStations(client, stations) {
+			continue
+		}
+		sessions = append(sessions, client)
+	}
+	return sessions, true
+}
+
+// matchStations tells whether the session was accounted with the given
+// NAS-Port-Id, Calling-Station-Id and Called-Station-Id
+func matchStations(client OVPNClient, stations map[AttributeType][]byte) bool {
+	if len(client.AccountingAttributes) == 0 {
+		return false
+	}
+
+	stored, err := DecodePacket(client.AccountingAttributes)
+	if err != nil {
+		log.Warnf("dynamicAuthorization: unable to read the attributes of %s: %s", client.Id, err.Error())
+		return false
+	}
+
+	for attributeType, value := range stations {
+		if storedValue, ok := stored.Get(attributeType); !ok || !bytes.Equal(storedValue, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// findSessions returns the sessions identified by the request, or the NAK
+// when the request cannot be applied. Attributes outside the supported ones
+// are refused as a whole, since RFC 5176 forbids partial changes
+func (d *dynamicAuthorization) findSessions(request *Packet, nakCode PacketCode, supported map[AttributeType]bool) ([]OVPNClient, *Packet) {
+	for _, attribute := range request.Attributes {
+		if !disconnectAttributes[attribute.Type] && !supported[attribute.Type] {
+			log.Warnf("dynamicAuthorization: unsupported attribute %s in %s", attribute.Type, request.Code)
+			return nil, dynamicAuthorizationNAK(nakCode, ErrorCauseUnsupportedAttribute)
+		}
+	}
+
+	if !checkNASIdentification(request) {
+		return nil, dynamicAuthorizationNAK(nakCode, ErrorCauseNASIdentificationMismatch)
+	}
+
+	clients, err := d.repository.All()
+	if err != nil {
+		log.Errorf("dynamicAuthorization: unable to read sessions %s", err.Error())
+		return nil, dynamicAuthorizationNAK(nakCode, ErrorCauseResourcesUnavailable)
+	}
+
+	// Clients that authenticated but did not connect have no session yet
+	var started []OVPNClient
+	for _, client := range clients {
+		if client.StartedAt > 0 {
+			started = append(started, client)
+		}
+	}
+
+	sessions, ok := matchSessions(started, request)
+	if !ok {
+		return nil, dynamicAuthorizationNAK(nakCode, ErrorCauseMissingAttribute)
+	}
+	if len(sessions) == 0 {
+		return nil, dynamicAuthorizationNAK(nakCode, ErrorCauseSessionContextNotFound)
+	}
+
+	return sessions, nil
+}
+
+// disconnect kills the sessions identified by a Disconnect-Request through the
+// management interface. OpenVPN then runs client-disconnect, which sends the
+// accounting Stop with Acct-Terminate-Cause Admin-Reset
+func (d *dynamicAuthorization) disconnect(request *Packet) *Packet {
+	sessions, nak := d.findSessions(request, CodeDisconnectNAK, nil)
+	if nak != nil {
+		return nak
+	}
+
+	management, release, err := openManagement()
+	if err != nil {
+		log.Errorf("dynamicAuthorization: unable to connect to management interface %s", err.Error())
+		return dynamicAuthorizationNAK(CodeDisconnectNAK, ErrorCauseResourcesUnavailable)
+	}
+	defer release()
+
+	clients, err := managementStatus(management)
+	if err != nil {
+		log.Errorf("dynamicAuthorization: unable to read OpenVPN status %s", err.Error())
+		return dynamicAuthorizationNAK(CodeDisconnectNAK, ErrorCauseResourcesUnavailable)
+	}
+
+	for _, session := range sessions {
+		// Without its client id the client cannot be killed
+		if _, ok := clients[session.Id]; !ok {
+			log.Errorf("dynamicAuthorization: user '%s' with Id %s is not connected to OpenVPN", session.CommonName, session.Id)
+			return dynamicAuthorizationNAK(CodeDisconnectNAK, ErrorCauseResourcesUnavailable)
+		}
+
+		if err := d.repository.SetTerminateCause(session.Id, AcctTerminateCauseAdminReset); err != nil {
+			log.Warnf("dynamicAuthorization: unable to record terminate cause of %s: %s", session.Id, err.Error())
+		}
+
+		if err := clientKill(management, clients, session.Id); err != nil {
+			log.Errorf("dynamicAuthorization: unable to disconnect %s: %s", session.Id, err.Error())
+			d.repository.SetTerminateCause(session.Id, 0)
+			return dynamicAuthorizationNAK(CodeDisconnectNAK, ErrorCauseSessionContextNotRemovable)
+		}
+		log.Info("dynamicAuthorization: disconnected user '" + session.CommonName + "' with Id " + session.Id)
+	}
+
+	return &Packet{Code: CodeDisconnectACK}
+}
+
+// changeOfAuthorization records the new Class, Acct-Interim-Interval,
+// Session-Timeout and Idle-Timeout of the sessions identified by a
+// CoA-Request. Later accounting requests carry the new Class and the interim
+// scheduler picks up the new interval and timeouts. A new Session-Timeout
+// counts from the time of the request
+func (d *dynamicAuthorization) changeOfAuthorization(request *Packet) *Packet {
+	// Re-authorization on request of the server is not supported (RFC 5176
+	// section 3.2)
+	if serviceType, ok := request.GetInteger(AttrServiceType); ok && serviceType == ServiceTypeAuthorizeOnly {
+		log.Warnf("dynamicAuthorization: unsupported Service-Type Authorize-Only in %s", request.Code)
+		response := dynamicAuthorizationNAK(CodeCoANAK, ErrorCauseUnsupportedService)
+		response.AddInteger(AttrServiceType, ServiceTypeAuthorizeOnly)
+		return response
+	}
+
+	sessions, nak := d.findSessions(request, CodeCoANAK, coaAttributes)
+	if nak != nil {
+		return nak
+	}
+
+	now := time.Now().Unix()
+
+	for _, session := range sessions {
+		if class, ok := request.Get(AttrClass); ok {
+			session.ClassName = encodeHexAttribute(class)
+		}
+		if interval, ok := request.GetInteger(AttrAcctInterimInterval); ok {
+			session.InterimInterval = int(interval)
+		}
+		if timeout, ok := request.GetInteger(AttrSessionTimeout); ok {
+			session.SessionTimeout = sessionTimeoutAfterStart(&session, timeout, now)
+		}
+		if timeout, ok := request.GetInteger(AttrIdleTimeout); ok {
+			session.IdleTimeout = int(timeout)
+		}
+
+		if err := d.repository.SetAuthorization(session); err != nil {
+			log.Errorf("dynamicAuthorization: unable to change session %s: %s", session.Id, err.Error())
+			return dynamicAuthorizationNAK(CodeCoANAK, ErrorCauseResourcesUnavailable)
+		}
+		log.Info("dynamicAuthorization: changed authorization of user '" + session.CommonName + "' with Id " + session.Id)
+	}
+
+	return &Packet{Code: CodeCoAACK}
+}
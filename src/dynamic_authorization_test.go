@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDisconnectRequest(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", IpAddress: "10.8.0.6", SessionId: "65A1F2C3-9F86D081884C7D65", StartedAt: 1700000000})
+	stations := &Packet{Code: CodeAccountingRequest}
+	stations.AddString(AttrCallingStationId, "192.0.2.11")
+	accountingAttributes, _ := stations.marshal(nil)
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", IpAddress: "10.8.0.7", SessionId: "65A1F2C3-0000000000000000", NASPort: 2, AccountingAttributes: accountingAttributes, StartedAt: 1700000000})
+
+	repository.Create(OVPNClient{Id: "192.0.2.12:50000", CommonName: "carol", IpAddress: "10.8.0.8", StartedAt: 1700000000})
+
+	// carol is no longer connected to OpenVPN
+	management := newTestManagement("192.0.2.10:50000", "192.0.2.11:50000")
+	setSharedManagement(management)
+	defer setSharedManagement(nil)
+
+	secret := "dae-secret"
+	saved, openvpn := config.Radius.DynamicAuthorization, config.OpenVPN
+	defer func() { config.Radius.DynamicAuthorization, config.OpenVPN = saved, openvpn }()
+	config.Radius.DynamicAuthorization.Clients = []ConfigDynamicAuthorizationClient{{Address: "127.0.0.0/8", Secret: secret}}
+	config.OpenVPN = ConfigOpenVPN{Management: "/run/openvpn/management.sock"}
+
+	d := newDynamicAuthorization(repository)
+	source := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	exchange := func(request *Packet, secret string) *Packet {
+		raw, err := request.Encode(secret)
+		if err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+		reply := d.respond(raw, source)
+		if reply == nil {
+			return nil
+		}
+		if err := VerifyResponse(reply, request, secret); err != nil {
+			t.Fatalf("Invalid reply: %v", err)
+		}
+		response, _ := DecodePacket(reply)
+		return response
+	}
+
+	request, _ := NewPacket(CodeDisconnectRequest)
+	request.AddIPAddress(AttrFramedIPAddress, net.ParseIP("10.8.0.6"))
+	request.AddString(AttrProxyState, "proxy")
+	request.AddMessageAuthenticator()
+
+	if response := exchange(request, "wrong-secret"); response != nil {
+		t.Fatalf("Requests with a wrong secret must be discarded")
+	}
+
+	response := exchange(request, secret)
+	if response == nil || response.Code != CodeDisconnectACK {
+		t.Fatalf("Expected Disconnect-ACK, got %+v", response)
+	}
+	if state, _ := response.GetString(AttrProxyState); state != "proxy" {
+		t.Fatalf("Proxy-State must be returned, got %q", state)
+	}
+	if len(management.commands) != 1 || management.commands[0] != "client-kill 1" {
+		t.Fatalf("Unexpected kill commands %q", management.commands)
+	}
+	if alice, _ := repository.GetById("192.0.2.10:50000"); alice.TerminateCause != AcctTerminateCauseAdminReset {
+		t.Fatalf("Expected Admin-Reset terminate cause, got %d", alice.TerminateCause)
+	}
+
+	// A retransmission is answered from the cache without a second kill
+	if response := exchange(request, secret); response == nil || response.Code != CodeDisconnectACK || len(management.commands) != 1 {
+		t.Fatalf("Expected cached Disconnect-ACK, got %+v", response)
+	}
+
+	nak := func(request *Packet, errorCause uint32) {
+		t.Helper()
+		response := exchange(request, secret)
+		if response == nil || response.Code != CodeDisconnectNAK {
+			t.Fatalf("Expected Disconnect-NAK, got %+v", response)
+		}
+		if cause, _ := response.GetInteger(AttrErrorCause); cause != errorCause {
+			t.Fatalf("Expected Error-Cause %d, got %d", errorCause, cause)
+		}
+	}
+
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddString(AttrUserName, "bob")
+	request.AddString(AttrAcctSessionId, "65A1F2C3-9F86D081884C7D65")
+	nak(request, ErrorCauseSessionContextNotFound)
+
+	// A session OpenVPN does not list cannot be killed
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddString(AttrUserName, "carol")
+	nak(request, ErrorCauseResourcesUnavailable)
+	if carol, _ := repository.GetById("192.0.2.12:50000"); carol.TerminateCause != 0 {
+		t.Fatalf("No terminate cause must be recorded for a session that was not killed")
+	}
+
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddString(AttrNASIdentifier, "OpenVPN")
+	nak(request, ErrorCauseMissingAttribute)
+
+	// Requests built from the accounting records identify the session by
+	// NAS-Port and Calling-Station-Id
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddInteger(AttrNASPort, 3)
+	request.AddString(AttrCallingStationId, "192.0.2.11")
+	nak(request, ErrorCauseSessionContextNotFound)
+
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddInteger(AttrNASPort, 2)
+	request.AddString(AttrCallingStationId, "192.0.2.11")
+	if response := exchange(request, secret); response == nil || response.Code != CodeDisconnectACK {
+		t.Fatalf("Expected Disconnect-ACK, got %+v", response)
+	}
+	if len(management.commands) != 2 || management.commands[1] != "client-kill 2" {
+		t.Fatalf("Unexpected kill commands %q", management.commands)
+	}
+
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddString(AttrUserName, "bob")
+	request.AddInteger(AttrSessionTimeout, 60)
+	nak(request, ErrorCauseUnsupportedAttribute)
+
+	request, _ = NewPacket(CodeDisconnectRequest)
+	request.AddString(AttrUserName, "bob")
+	request.AddString(AttrNASIdentifier, "another-nas")
+	nak(request, ErrorCauseNASIdentificationMismatch)
+}
+
+func TestCoARequest(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	startedAt := time.Now().Unix() - 600
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", IpAddress: "10.8.0.6", ClassName: "0x6f6c64", StartedAt: startedAt, InterimInterval: 300})
+
+	secret := "dae-secret"
+	saved := config.Radius.DynamicAuthorization
+	defer func() { config.Radius.DynamicAuthorization = saved }()
+	config.Radius.DynamicAuthorization.Clients = []ConfigDynamicAuthorizationClient{{Address: "127.0.0.1", Secret: secret}}
+
+	d := newDynamicAuthorization(repository)
+	source := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	exchange := func(request *Packet) *Packet {
+		raw, _ := request.Encode(secret)
+		reply := d.respond(raw, source)
+		if reply == nil {
+			t.Fatalf("%s was discarded", request.Code)
+		}
+		if err := VerifyResponse(reply, request, secret); err != nil {
+			t.Fatalf("Invalid reply: %v", err)
+		}
+		response, _ := DecodePacket(reply)
+		return response
+	}
+
+	request, _ := NewPacket(CodeCoARequest)
+	request.AddString(AttrUserName, "alice")
+	request.AddString(AttrClass, "new")
+	request.AddInteger(AttrAcctInterimInterval, 600)
+	request.AddInteger(AttrSessionTimeout, 3600)
+	request.AddInteger(AttrIdleTimeout, 900)
+
+	if response := exchange(request); response.Code != CodeCoAACK {
+		t.Fatalf("Expected CoA-ACK, got %s", response.Code)
+	}
+
+	client, err := repository.GetById("192.0.2.10:50000")
+	if err != nil {
+		t.Fatalf("Failed to read session: %v", err)
+	}
+	if client.ClassName != encodeHexAttribute([]byte("new")) || client.InterimInterval != 600 || client.IdleTimeout != 900 || client.IpAddress != "10.8.0.6" {
+		t.Fatalf("Unexpected session after CoA: %+v", client)
+	}
+	// The new Session-Timeout counts from the CoA-Request, not from the session start
+	if elapsed := client.SessionTimeout - 3600; elapsed < 600 || elapsed > 610 {
+		t.Fatalf("Unexpected Session-Timeout %d", client.SessionTimeout)
+	}
+
+	// Changes that cannot be applied to a live session are refused as a whole
+	request, _ = NewPacket(CodeCoARequest)
+	request.AddString(AttrUserName, "alice")
+	request.AddString(AttrClass, "other")
+	request.AddString(AttrFilterId, "restricted")
+
+	response := exchange(request)
+	if cause, _ := response.GetInteger(AttrErrorCause); response.Code != CodeCoANAK || cause != ErrorCauseUnsupportedAttribute {
+		t.Fatalf("Expected CoA-NAK with Unsupported-Attribute, got %s %d", response.Code, cause)
+	}
+	if client, _ := repository.GetById("192.0.2.10:50000"); client.ClassName != encodeHexAttribute([]byte("new")) {
+		t.Fatalf("Refused CoA-Request must not change the session")
+	}
+
+	// The server cannot ask for a re-authorization
+	request, _ = NewPacket(CodeCoARequest)
+	request.AddString(AttrUserName, "alice")
+	request.AddInteger(AttrServiceType, ServiceTypeAuthorizeOnly)
+	request.AddString(AttrState, "state")
+
+	response = exchange(request)
+	if cause, _ := response.GetInteger(AttrErrorCause); response.Code != CodeCoANAK || cause != ErrorCauseUnsupportedService {
+		t.Fatalf("Expected CoA-NAK with Unsupported-Service, got %s %d", response.Code, cause)
+	}
+
+	// A client that authenticated but did not connect has no session to change
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", IpAddress: "10.8.0.7"})
+	request, _ = NewPacket(CodeCoARequest)
+	request.AddString(AttrUserName, "bob")
+	request.AddInteger(AttrIdleTimeout, 900)
+
+	response = exchange(request)
+	if cause, _ := response.GetInteger(AttrErrorCause); response.Code != CodeCoANAK || cause != ErrorCauseSessionContextNotFound {
+		t.Fatalf("Expected CoA-NAK with Session-Context-Not-Found, got %s %d", response.Code, cause)
+	}
+}
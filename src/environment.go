@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// environment holds the variables OpenVPN passes to a hook: the process
+// environment of a script or the envp of a plugin call
+type environment map[string]string
+
+// parseEnvironment reads "name=value" entries
+func parseEnvironment(entries []string) environment {
+	env := make(environment, len(entries))
+	for _, entry := range entries {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// processEnvironment returns the environment of a script invocation
+func processEnvironment() environment {
+	return parseEnvironment(os.Environ())
+}
+
+func (e environment) Get(name string) string {
+	return e[name]
+}
+
+// clientId identifies the client connection, as used for OVPNClient.Id.
+// Clients connected over IPv6 only have untrusted_ip6
+func (e environment) clientId() string {
+	ip := e.Get("untrusted_ip")
+	if len(ip) == 0 {
+		ip = e.Get("untrusted_ip6")
+	}
+	return ip + ":" + e.Get("untrusted_port")
+}
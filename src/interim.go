@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	interimCheckInterval = 15 * time.Second
+
+	// RFC 2869 section 5.16: the interval should not be smaller than 60 seconds
+	minimumInterimInterval = 60
+)
+
+// interimUpdates runs until the process is stopped and sends an
+// Interim-Update for every started session whose interval has elapsed. It
+// also enforces the Session-Timeout and Idle-Timeout of the sessions
+func interimUpdates(repository *SQLiteRepository) {
+	log.Infof("interimUpdates: checking sessions every %s", interimCheckInterval)
+
+	ticker := time.NewTicker(interimCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().Unix()
+		sendInterimUpdates(repository, now)
+		enforceTimeouts(repository, now)
+		<-ticker.C
+	}
+}
+
+func sendInterimUpdates(repository *SQLiteRepository, now int64) {
+	clients, err := repository.All()
+	if err != nil {
+		log.Errorf("interimUpdates: unable to read sessions %s", err.Error())
+		return
+	}
+
+	var status map[string]statusClient
+
+	for _, client := range clients {
+		// Authenticated clients have no session until client-connect sent Start
+		if client.StartedAt == 0 || len(client.SessionId) == 0 {
+			continue
+		}
+
+		interval := interimInterval(client)
+		if interval <= 0 {
+			continue
+		}
+
+		lastUpdate := client.LastInterimAt
+		if lastUpdate == 0 {
+			lastUpdate = client.StartedAt
+		}
+		if now-lastUpdate < int64(interval) {
+			continue
+		}
+
+		if status == nil {
+			status, err = readStatus()
+			if err != nil {
+				log.Warnf("interimUpdates: unable to read OpenVPN status %s", err.Error())
+				status = map[string]statusClient{}
+			}
+		}
+
+		request, err := newAccountingRequest(AcctStatusTypeInterimUpdate, &client, client.IpAddress)
+		if err != nil {
+			log.Errorf("interimUpdates: unable to build request for %s: %s", client.Id, err.Error())
+			continue
+		}
+
+		// Octets of zero would read as a counter reset, so they are left out
+		// when OpenVPN did not report the client
+		if entry, ok := status[client.Id]; ok {
+			entry.counters(now).addTo(request)
+		} else {
+			request.AddInteger(AttrAcctSessionTime, uint32(now-client.StartedAt))
+		}
+
+		if err := deliverAccountingRequest(repository, request); err != nil {
+			log.Errorf("interimUpdates: Interim-Update for %s failed: %s", client.Id, err.Error())
+			continue
+		}
+
+		if err := repository.SetLastInterim(client.Id, now); err != nil {
+			log.Warnf("interimUpdates: unable to record Interim-Update for %s: %s", client.Id, err.Error())
+			continue
+		}
+
+		log.Info("interimUpdates: sent Interim-Update for user '" + client.CommonName + "' with Id " + client.Id)
+	}
+}
+
+// interimInterval returns the Acct-Interim-Interval from Access-Accept, or the
+// configured default, in seconds. Zero disables interim updates
+func interimInterval(client OVPNClient) int {
+	interval := client.InterimInterval
+	if interval <= 0 {
+		interval = config.Radius.InterimInterval
+	}
+	if interval > 0 && interval < minimumInterimInterval {
+		interval = minimumInterimInterval
+	}
+	return interval
+}
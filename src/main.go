@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
-	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
@@ -18,38 +17,21 @@ import (
 
 var config Config
 
+// NAS-Ports reserved for an authentication that did not lead to a session are
+// released after this many seconds
+const nasPortReservationLifetime = 600
+
 //code 1
 func init() {
-	jsonFile, err := os.Open("/etc/openvpn/plugin/config.json")
-	if err != nil {
-		log.Errorf("init: failed with %s\n", err)
-		os.Exit(10)
-	}
-	defer jsonFile.Close()
-
-	byteValue, err := ioutil.ReadAll(jsonFile)
-
-	if err != nil {
-		log.Errorf("init: failed with %s\n", err)
-		os.Exit(11)
-	}
-
-	json.Unmarshal(byteValue, &config)
-
-	if len(config.LogFile) <= 0 {
-		log.Errorf("init: config file is null")
-		os.Exit(12)
+	// The plugin loads its configuration when OpenVPN opens it
+	if nativePlugin {
+		return
 	}
 
-	file, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
+	if err := loadConfig(configFile); err != nil {
 		log.Errorf("init: failed with %s\n", err)
-		os.Exit(13)
+		os.Exit(10)
 	}
-
-	log.SetOutput(file)
-
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true, PadLevelText: true})
 }
 
 //code 2
@@ -109,215 +91,464 @@ func authenticateUser(repository *SQLiteRepository) {
 	if len(username) <= 0 || len(password) <= 0 {
 		log.Errorf("authenticate: unable to authenticate username or password is null")
 		os.Exit(33)
-	} else {
-		log.Info("authenticate: trying to authenticate to " + config.Radius.Authentication.Server)
-		authenticationData := "Response-Packet-Type=Access-Accept,NAS-Identifier=" + config.ServerInfo.Identifier + ",NAS-Port-Type=" + config.ServerInfo.PortType + ",NAS-IP-Address=" + config.ServerInfo.IpAddress + ",Service-Type=" + config.ServerInfo.ServiceType + ",Framed-Protocol=1,User-Name=" + username + ",User-Password='" + password + "',Framed-Protocol=PPP,Message-Authenticator=0x00"
+	}
 
-		radClientPath := "/usr/bin/radclient"
+	env := processEnvironment()
 
-		cmdArgs := []string{"-x", config.Radius.Authentication.Server, "auth", config.Radius.Authentication.Secret}
+	if config.Radius.DeferredAuth && len(env.Get("auth_control_file")) > 0 {
+		if err := deferAuthentication(username, password); err != nil {
+			log.Errorf("authenticate: unable to start deferred authentication %s", err.Error())
+			os.Exit(34)
+		}
+		log.Info("authenticate: authentication of user '" + username + "' deferred")
+		os.Exit(2)
+	}
 
-		var stdout, stderr bytes.Buffer
+	os.Exit(authenticate(repository, env, username, password))
+}
 
-		cmd := exec.Command(radClientPath, cmdArgs...)
+// authenticate sends the credentials to RADIUS and stores the accepted
+// session. It returns the exit code reported to OpenVPN: 0 when accepted,
+// 2 when the result is pending on a client challenge response
+func authenticate(repository *SQLiteRepository, env environment, username string, password string) int {
+	log.Info("authenticate: trying to authenticate user '" + username + "'")
 
-		cmd.Stdin = bytes.NewBufferString(authenticationData)
+	var challenge *Challenge
 
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
+	if stateId, challengeResponse, ok := parseDynamicChallengeResponse(password); ok {
+		var errChallenge error
+		challenge, errChallenge = takeChallenge(repository, stateId, username)
+		if errChallenge != nil {
+			log.Errorf("authenticate: unable to find challenge for user '%s': %s", username, errChallenge.Error())
+			return 38
+		}
+		log.Info("authenticate: user '" + username + "' answered challenge " + challenge.Id)
+		password = challengeResponse
+	}
 
-		err := cmd.Run()
+	password, otp, err := splitStaticChallenge(password)
+	if err != nil {
+		log.Errorf("authenticate: unable to read static challenge password %s", err.Error())
+		return 33
+	}
 
+	// Every request of the client and its session carries the same NAS-Port
+	var nasPort int
+	if !config.Radius.AuthenticationOnly {
+		now := time.Now().Unix()
+		nasPort, err = repository.AllocateNASPort(env.clientId(), now, now-nasPortReservationLifetime)
+		if err != nil {
+			log.Errorf("authenticate: unable to allocate NAS-Port %s", err.Error())
+			return 34
+		}
+	}
+
+	request, err := newAccessRequest(env, username, password)
+	if err != nil {
+		log.Errorf("authenticate: Error: %s", err.Error())
+		return 34
+	}
+	addNASPort(request, nasPort)
+
+	if challenge != nil && len(challenge.State) > 0 {
+		request.Add(AttrState, challenge.State)
+	}
+	otp.addTo(request)
+
+	response, err := authenticationServers(repository).Exchange(request)
+	if err != nil {
+		log.Errorf("authenticate: Error: %s", err.Error())
+		return 35
+	}
+
+	log.Info("authenticate: received " + response.Code.String())
+
+	// Answer the challenge with the static challenge OTP without a round trip to the client
+	if otp.answers(response) {
+		request, err = newAccessRequest(env, username, otp.response)
 		if err != nil {
 			log.Errorf("authenticate: Error: %s", err.Error())
-			os.Exit(34)
+			return 34
 		}
+		addNASPort(request, nasPort)
 
-		outStrs := strings.Split(stdout.String(), "\n")
-		//errStrs := strings.Split(stderr.String(), "\n")
+		if state, ok := response.Get(AttrState); ok {
+			request.Add(AttrState, state)
+		}
 
-		if len(outStrs) <= 0 {
-			log.Errorf("authenticate: No Output Received!")
-			os.Exit(35)
+		response, err = authenticationServers(repository).Exchange(request)
+		if err != nil {
+			log.Errorf("authenticate: Error: %s", err.Error())
+			return 35
 		}
 
-		var isAutenticated bool
+		log.Info("authenticate: received " + response.Code.String() + " for static challenge response")
+	}
 
-		var className string
+	if response.Code == CodeAccessChallenge {
+		return issueChallenge(repository, env, username, response)
+	}
 
-		for _, outStr := range outStrs {
-			if strings.HasPrefix(outStr, "Received Access-Accept Id") {
-				isAutenticated = true
-			}
+	if response.Code != CodeAccessAccept {
+		log.Errorf("authenticate: failed to authenticate!")
+		if err := repository.ReleaseNASPort(env.clientId()); err != nil {
+			log.Warnf("authenticate: unable to release NAS-Port %s", err.Error())
+		}
+		return 36
+	}
 
-			if strings.HasPrefix(outStr, "\tClass") {
-				classArray := strings.Split(outStr, "=")
-				untestedClassName := strings.Trim(classArray[1], " ")
-				if isValidUTF8FromHex(untestedClassName) {
-					className = untestedClassName
-				}
-			}
+	var className string
+
+	interimInterval, _ := response.GetInteger(AttrAcctInterimInterval)
+	sessionTimeout, _ := response.GetInteger(AttrSessionTimeout)
+	idleTimeout, _ := response.GetInteger(AttrIdleTimeout)
+	terminationAction, _ := response.GetInteger(AttrTerminationAction)
+
+	var stateName string
+	if state, ok := response.Get(AttrState); ok {
+		stateName = encodeHexAttribute(state)
+	}
+	framedIPAddress, framedIPNetmask := framedAddress(response)
+	framedIPv6Address, framedInterfaceId := framedIPv6Address(response)
+	routes := strings.Join(framedRoutes(response), " ")
+
+	if class, ok := response.Get(AttrClass); ok {
+		if utf8.Valid(class) {
+			className = encodeHexAttribute(class)
 		}
+	}
 
-		if !isAutenticated {
-			log.Errorf("authenticate: failed to authenticate!")
-			os.Exit(36)
+	log.Info("authenticate: user '" + username + "' with class '" + className + "' is authenticated sucessfully")
+
+	// Check for empty class attribute and provide helpful message
+	if len(className) == 0 {
+		log.Warn("authenticate: Class attribute is empty. Please ensure 'insert_acct_class' is enabled in FreeRadius configuration.")
+	}
+
+	// If AuthenticationOnly is enabled no need to update DB
+	if !config.Radius.AuthenticationOnly {
+		attributes, err := accessAttributes(env)
+		if err != nil {
+			log.Errorf("authenticate: Error: %s", err.Error())
+			return 34
 		}
 
-		log.Info("authenticate: user '" + username + "' with class '" + className + "' is authenticated sucessfully")
+		clientId := env.clientId()
+		newClient := OVPNClient{
+			Id:                clientId,
+			CommonName:        username,
+			ClassName:         className,
+			MultiSessionId:    env.Get("session_id"),
+			InterimInterval:   int(interimInterval),
+			FramedIPAddress:   framedIPAddress,
+			FramedIPNetmask:   framedIPNetmask,
+			FramedRoutes:      routes,
+			FramedIPv6Address: framedIPv6Address,
+			FramedInterfaceId: framedInterfaceId,
+			SessionTimeout:    int(sessionTimeout),
+			IdleTimeout:       int(idleTimeout),
+			TerminationAction: terminationAction,
+			StateName:         stateName,
+			NASPort:           nasPort,
+			AccessAttributes:  attributes,
+		}
 
-		// Check for empty class attribute and provide helpful message
-		if len(className) == 0 {
-			log.Warn("authenticate: Class attribute is empty. Please ensure 'insert_acct_class' is enabled in FreeRadius configuration.")
+		// Check if record already exists (handles TLS renegotiation case)
+		existingClient, errGet := repository.GetById(clientId)
+		if errGet != nil && errGet != ErrNotExists {
+			log.Errorf("authenticate: failed to check existing account data with error %s\n", errGet)
+			return 37
 		}
 
-		// If AuthenticationOnly is enabled no need to update DB
-		if !config.Radius.AuthenticationOnly {
-			clientId := os.Getenv("untrusted_ip") + ":" + os.Getenv("untrusted_port")
-			newClient := OVPNClient{
-				Id:         clientId,
-				CommonName: username,
-				ClassName:  className,
+		if existingClient != nil {
+			// Record exists - update it (TLS renegotiation scenario)
+			existingClient.CommonName = username
+			existingClient.ClassName = className
+			existingClient.InterimInterval = int(interimInterval)
+			existingClient.FramedIPAddress = framedIPAddress
+			existingClient.FramedIPNetmask = framedIPNetmask
+			existingClient.FramedRoutes = routes
+			existingClient.FramedIPv6Address = framedIPv6Address
+			existingClient.FramedInterfaceId = framedInterfaceId
+			existingClient.SessionTimeout = sessionTimeoutAfterStart(existingClient, sessionTimeout, time.Now().Unix())
+			existingClient.IdleTimeout = int(idleTimeout)
+			existingClient.TerminationAction = terminationAction
+			existingClient.StateName = stateName
+			existingClient.NASPort = nasPort
+			existingClient.AccessAttributes = attributes
+			_, errUpdate := repository.Update(*existingClient)
+			if errUpdate != nil {
+				log.Errorf("authenticate: failed to update existing account data with error %s\n", errUpdate)
+				return 37
 			}
-
-			// Check if record already exists (handles TLS renegotiation case)
-			existingClient, errGet := repository.GetById(clientId)
-			if errGet != nil && errGet != ErrNotExists {
-				log.Errorf("authenticate: failed to check existing account data with error %s\n", errGet)
-				os.Exit(37)
+			log.Info("authenticate: updated existing user '" + username + "' with class '" + className + "' data.")
+		} else {
+			// Record doesn't exist - create new one with a fresh accounting session
+			sessionId, errSession := newSessionId()
+			if errSession != nil {
+				log.Errorf("authenticate: failed to generate session id with error %s\n", errSession)
+				return 37
 			}
+			newClient.SessionId = sessionId
 
-			if existingClient != nil {
-				// Record exists - update it (TLS renegotiation scenario)
-				existingClient.CommonName = username
-				existingClient.ClassName = className
-				_, errUpdate := repository.Update(*existingClient)
-				if errUpdate != nil {
-					log.Errorf("authenticate: failed to update existing account data with error %s\n", errUpdate)
-					os.Exit(37)
-				}
-				log.Info("authenticate: updated existing user '" + username + "' with class '" + className + "' data.")
-			} else {
-				// Record doesn't exist - create new one
-				_, errCreate := repository.Create(newClient)
-				if errCreate != nil {
-					log.Errorf("authenticate: failed to save account data with error %s\n", errCreate)
-					os.Exit(37)
-				}
-				log.Info("authenticate: saved new user '" + username + "' with class '" + className + "' data.")
+			_, errCreate := repository.Create(newClient)
+			if errCreate != nil {
+				log.Errorf("authenticate: failed to save account data with error %s\n", errCreate)
+				return 37
 			}
+			log.Info("authenticate: saved new user '" + username + "' with class '" + className + "' data.")
+		}
+	}
+
+	return 0
+}
+
+// newAccessRequest builds the Access-Request of a user with the configured
+// attributes expanded over the OpenVPN environment of the client
+func newAccessRequest(env environment, username string, password string) (*Packet, error) {
+	request, err := NewPacket(CodeAccessRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	request.AddString(AttrUserName, username)
+	if err := request.AddPassword(password); err != nil {
+		return nil, err
+	}
+	if err := addServerInfo(request); err != nil {
+		return nil, err
+	}
+
+	if err := addAttributes(request, accessRequestAttributes(), env); err != nil {
+		return nil, err
+	}
+	request.AddMessageAuthenticator()
+
+	return request, nil
+}
+
+// addNASPort adds the NAS-Port allocated to the session, when there is one
+func addNASPort(request *Packet, nasPort int) {
+	if nasPort > 0 {
+		request.AddInteger(AttrNASPort, uint32(nasPort))
+	}
+}
+
+// addServerInfo adds the NAS identity configured in ServerInfo. The address
+// is sent as NAS-IP-Address or NAS-IPv6-Address (RFC 3162) by its family
+func addServerInfo(request *Packet) error {
+	request.AddString(AttrNASIdentifier, config.ServerInfo.Identifier)
+
+	ip := net.ParseIP(config.ServerInfo.IpAddress)
+	if ip == nil {
+		return errors.New("invalid ServerInfo.IpAddress " + config.ServerInfo.IpAddress)
+	}
+	if ip.To4() != nil {
+		if err := request.AddIPAddress(AttrNASIPAddress, ip); err != nil {
+			return err
 		}
+	} else if err := request.AddIPv6Address(AttrNASIPv6Address, ip); err != nil {
+		return err
+	}
 
-		os.Exit(0)
+	// An IPv6 IpAddress is already sent as NAS-IPv6-Address
+	if ipv6 := net.ParseIP(config.ServerInfo.Ipv6Address); ipv6 != nil && !ipv6.Equal(ip) {
+		return request.AddIPv6Address(AttrNASIPv6Address, ipv6)
 	}
+	return nil
 }
 
-//code 5
-func isValidUTF8FromHex(hexaString string) bool {
-	numberStr := strings.Replace(strings.ToLower(hexaString), "0x", "", -1)
+func encodeHexAttribute(value []byte) string {
+	return "0x" + hex.EncodeToString(value)
+}
+
+func decodeHexAttribute(hexaString string) ([]byte, error) {
+	return hex.DecodeString(strings.Replace(strings.ToLower(hexaString), "0x", "", -1))
+}
 
-	decoded, err := hex.DecodeString(numberStr)
+func newAccountingRequest(statusType uint32, client *OVPNClient, ipAddress string) (*Packet, error) {
+	request, err := NewPacket(CodeAccountingRequest)
 	if err != nil {
-		log.Errorf("isValidUTF8FromHex: failed with %s\n", err)
-		os.Exit(50)
+		return nil, err
+	}
+
+	if len(client.ClassName) > 0 {
+		class, err := decodeHexAttribute(client.ClassName)
+		if err != nil {
+			return nil, err
+		}
+		request.Add(AttrClass, class)
+	}
+
+	request.AddString(AttrAcctSessionId, client.SessionId)
+	if len(client.MultiSessionId) > 0 {
+		request.AddString(AttrAcctMultiSessionId, client.MultiSessionId)
+	}
+	request.AddInteger(AttrAcctStatusType, statusType)
+	request.AddString(AttrUserName, client.CommonName)
+	if err := addServerInfo(request); err != nil {
+		return nil, err
 	}
+	addNASPort(request, client.NASPort)
 
-	return utf8.Valid(decoded)
+	if ip := net.ParseIP(ipAddress); ip != nil {
+		if err := request.AddIPAddress(AttrFramedIPAddress, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	if ip := net.ParseIP(client.Ipv6Address); ip != nil {
+		if err := request.AddIPv6Address(AttrFramedIPv6Address, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(client.AccountingAttributes) > 0 {
+		stored, err := DecodePacket(client.AccountingAttributes)
+		if err != nil {
+			return nil, err
+		}
+		request.Attributes = append(request.Attributes, stored.Attributes...)
+	}
+
+	return request, nil
+}
+
+// sendAccountingRequest sends the request to the accounting server and waits
+// for a verified Accounting-Response
+func sendAccountingRequest(repository *SQLiteRepository, request *Packet) error {
+	response, err := accountingServers(repository).Exchange(request)
+	if err != nil {
+		return err
+	}
+
+	if response.Code != CodeAccountingResponse {
+		return errors.New("unexpected " + response.Code.String() + " received")
+	}
+
+	return nil
 }
 
 //code 6
-func accountingRequest(requestType string, repository *SQLiteRepository, sessionId int) {
-	log.Info("accountingRequest: prepare send request to " + config.Radius.Accounting.Server + " with request type: " + requestType)
-	var accountingCommand string
-	userId := os.Getenv("untrusted_ip") + ":" + os.Getenv("untrusted_port")
-	userIpAddress := os.Getenv("ifconfig_pool_remote_ip")
+func accountingRequest(requestType string, repository *SQLiteRepository) {
+	env := processEnvironment()
+
+	exitCode := accounting(repository, env, requestType)
+
+	// OpenVPN passes the file to write client directives to as client-connect argument
+	if exitCode == 0 && requestType == "start" && len(os.Args) > 2 {
+		directives, err := connectConfig(repository, env)
+		if err == nil {
+			err = writeClientConfig(os.Args[2], directives)
+		}
+		if err != nil {
+			log.Errorf("accountingRequest: unable to write client config %s", err.Error())
+			os.Exit(64)
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+// accounting sends the Accounting-Request of the given type for the client
+// and returns the exit code reported to OpenVPN
+func accounting(repository *SQLiteRepository, env environment, requestType string) int {
+	log.Info("accountingRequest: prepare send request with request type: " + requestType)
+	userId := env.clientId()
+	userIpAddress := env.Get("ifconfig_pool_remote_ip")
 
 	log.Info("accountingRequest: get user data with Id " + userId)
 	userClient, errClient := repository.GetById(userId)
 	if errClient != nil {
 		log.Errorf("accountingRequest: Error: %s", errClient.Error())
-		os.Exit(60)
+		return 60
+	}
+
+	// An address assigned by RADIUS is pushed instead of the pool address
+	if push, err := ifconfigPush(userClient, env); err == nil && len(push) > 0 {
+		userIpAddress = userClient.FramedIPAddress
 	}
 
 	if requestType == "start" {
 		log.Info("accountingRequest: update user data ip address to " + userIpAddress + " with Id " + userId)
 		userClient.IpAddress = userIpAddress
+
+		// As for IPv4 the pushed address replaces the pool address
+		userClient.Ipv6Address = env.Get("ifconfig_pool_remote_ip6")
+		if address, err := ipv6PushAddress(userClient, env); err == nil && len(address) > 0 {
+			userClient.Ipv6Address, _, _ = strings.Cut(address, "/")
+		}
+
+		userClient.StartedAt = time.Now().Unix()
+		userClient.LastInterimAt = 0
+		userClient.LastActivityAt = 0
+		userClient.TerminateCause = 0
+
+		attributes, err := accountingAttributes(env)
+		if err != nil {
+			log.Errorf("accountingRequest: Error: %s", err.Error())
+			return 62
+		}
+		userClient.AccountingAttributes = attributes
+
+		// Rows created before session ids were stored get one on their first Start
+		if len(userClient.SessionId) == 0 {
+			sessionId, err := newSessionId()
+			if err != nil {
+				log.Errorf("accountingRequest: Error: %s", err.Error())
+				return 61
+			}
+			userClient.SessionId = sessionId
+		}
+
 		if _, errClient := repository.Update(*userClient); errClient != nil {
 			log.Errorf("accountingRequest: Error: %s", errClient.Error())
-			os.Exit(61)
+			return 61
 		}
 	}
 
+	var statusType uint32
+
 	switch requestType {
 	case "start":
-		accountingCommand = "Class=" + userClient.ClassName + ",Acct-Session-Id=" + strconv.Itoa(sessionId) + ",Acct-Status-Type=Start,User-Name=" + userClient.CommonName + ",Calling-Station-Id=" + config.ServerInfo.IpAddress + ",NAS-Identifier=" + config.ServerInfo.Identifier + ",Framed-IP-Address=" + userIpAddress
-	case "update":
-		accountingCommand = "Class=" + userClient.ClassName + ",Acct-Session-Id=" + strconv.Itoa(sessionId) + ",Acct-Status-Type=Interim-Update,User-Name=" + userClient.CommonName + ",Calling-Station-Id=" + config.ServerInfo.IpAddress + ",NAS-Identifier=" + config.ServerInfo.Identifier + ",Framed-IP-Address=" + userIpAddress
+		statusType = AcctStatusTypeStart
 	case "stop":
-		accountingCommand = "Class=" + userClient.ClassName + ",Acct-Session-Id=" + strconv.Itoa(sessionId) + ",Acct-Status-Type=Stop,User-Name=" + userClient.CommonName + ",Calling-Station-Id=" + config.ServerInfo.IpAddress + ",NAS-Identifier=" + config.ServerInfo.Identifier + ",Framed-IP-Address=" + userIpAddress + ",Acct-Terminate-Cause=User-Request"
+		statusType = AcctStatusTypeStop
 	default:
 		log.Errorf("accountingRequest: '" + requestType + "' request type is unknown.")
-		os.Exit(61)
+		return 61
 	}
 
-	log.Info("accountingRequest: sent request to " + config.Radius.Accounting.Server + " with request type: " + requestType)
-
-	radClientPath := "/usr/bin/radclient"
-
-	cmdArgs := []string{"-x", config.Radius.Accounting.Server, "acct", config.Radius.Accounting.Secret}
-
-	var stdout, stderr bytes.Buffer
-
-	cmd := exec.Command(radClientPath, cmdArgs...)
-
-	cmd.Stdin = bytes.NewBufferString(accountingCommand)
-
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-
+	request, err := newAccountingRequest(statusType, userClient, userIpAddress)
 	if err != nil {
 		log.Errorf("accountingRequest: error: %s", err.Error())
-		os.Exit(62)
+		return 62
 	}
 
-	outStrs := strings.Split(stdout.String(), "\n")
-
-	if len(outStrs) <= 0 {
-		log.Errorf("accountingRequest: no output received!")
-		os.Exit(63)
+	if statusType == AcctStatusTypeStop {
+		countersFromEnvironment(env).addTo(request)
+		request.AddInteger(AttrAcctTerminateCause, terminateCause(userClient, env, time.Now().Unix()))
 	}
 
-	var isReceived bool
-
-	for _, outStr := range outStrs {
-		if strings.HasPrefix(outStr, "Received Accounting-Response Id") {
-			isReceived = true
-		}
-	}
+	log.Info("accountingRequest: sent request with request type: " + requestType)
 
-	if !isReceived {
-		log.Errorf("accountingRequest: no Accounting-Response received!")
-		os.Exit(64)
+	if err := deliverAccountingRequest(repository, request); err != nil {
+		log.Errorf("accountingRequest: error: %s", err.Error())
+		return 63
 	}
 
-	log.Info("accountingRequest: received Accounting-Response from " + config.Radius.Accounting.Server)
+	log.Info("accountingRequest: delivered request with request type: " + requestType)
 
 	if requestType == "stop" {
 		if err := repository.Delete(userClient.Id); err != nil {
 			log.Errorf("accountingRequest: unable to delete data %s", err.Error())
-			os.Exit(65)
+			return 65
 		}
 
 		log.Info("accountingRequest: delete user data with Id " + userId)
 	}
 
-	if requestType == "start" {
-		accountingRequest("update", repository, sessionId)
-	}
-
-	os.Exit(0)
+	return 0
 }
 
 func main() {
@@ -334,14 +565,21 @@ func main() {
 		os.Exit(100)
 	}
 
+	executionType := string(os.Args[1])
+
+	// Hooks are thin clients of the daemon when one is configured
+	if len(config.Daemon.Socket) > 0 {
+		if exitCode, ok := forwardHook(executionType); ok {
+			os.Exit(exitCode)
+		}
+	}
+
 	repository, err := InitializeDatabase(false)
 	if err != nil {
 		log.Errorf("main: error %s.", err)
 		os.Exit(101)
 	}
 
-	executionType := string(os.Args[1])
-
 	switch executionType {
 	case "env":
 		log.Info("main: running with execution type 'env'")
@@ -351,12 +589,37 @@ func main() {
 		authenticateUser(repository)
 	case "acct":
 		log.Info("main: running with execution type 'acct'")
-		sessionId := rand.Intn(9999)
-		accountingRequest("start", repository, sessionId)
+		accountingRequest("start", repository)
 	case "stop":
 		log.Info("main: running with execution type 'stop'")
-		sessionId := rand.Intn(9999)
-		accountingRequest("stop", repository, sessionId)
+		accountingRequest("stop", repository)
+	case "up":
+		log.Info("main: running with execution type 'up'")
+		nasAccounting(AcctStatusTypeAccountingOn, repository)
+	case "down":
+		log.Info("main: running with execution type 'down'")
+		nasAccounting(AcctStatusTypeAccountingOff, repository)
+	case "acct-flush":
+		log.Info("main: running with execution type 'acct-flush'")
+		accountingFlush(repository)
+	case "auth-worker":
+		log.Info("main: running with execution type 'auth-worker'")
+		authenticationWorker(repository)
+	case "crresponse":
+		log.Info("main: running with execution type 'crresponse'")
+		challengeResponse(repository)
+	case "interim":
+		log.Info("main: running with execution type 'interim'")
+		interimUpdates(repository)
+	case "daemon":
+		log.Info("main: running with execution type 'daemon'")
+		runDaemon(repository)
+	case "management":
+		log.Info("main: running with execution type 'management'")
+		runManagement(repository)
+	case "dae":
+		log.Info("main: running with execution type 'dae'")
+		runDynamicAuthorization(repository)
 	default:
 		log.Errorf("main: '" + executionType + "' execution type is unknown.")
 		os.Exit(101)
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	managementTimeout        = 10 * time.Second
+	managementPasswordPrompt = "ENTER PASSWORD:"
+)
+
+var ErrManagementPassword = errors.New("management interface rejected the password")
+
+// managementCommander runs commands on the management interface
+type managementCommander interface {
+	Command(command string) ([]string, error)
+}
+
+// sharedManagement is the connection held by "ovpn-radius management".
+// OpenVPN serves one management client at a time, so the other commands of
+// that process go through it instead of connecting themselves
+var sharedManagement struct {
+	mutex     sync.Mutex
+	commander managementCommander
+}
+
+func setSharedManagement(commander managementCommander) {
+	sharedManagement.mutex.Lock()
+	defer sharedManagement.mutex.Unlock()
+
+	sharedManagement.commander = commander
+}
+
+// openManagement returns the shared management connection or, without one,
+// connects to OpenVPN.Management. The returned function releases it
+func openManagement() (managementCommander, func(), error) {
+	sharedManagement.mutex.Lock()
+	shared := sharedManagement.commander
+	sharedManagement.mutex.Unlock()
+
+	if shared != nil {
+		return shared, func() {}, nil
+	}
+
+	if managementMode {
+		return nil, nil, errors.New("management interface is not connected")
+	}
+
+	client, err := DialManagement(config.OpenVPN.Management, config.OpenVPN.ManagementPassword)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+// clientKill disconnects the connected client with the real address id by
+// its client id. "kill" only takes a common name or an IPv4 address and port,
+// which leaves out IPv6 clients
+func clientKill(management managementCommander, clients map[string]statusClient, id string) error {
+	client, ok := clients[id]
+	if !ok || len(client.ClientId) == 0 {
+		return errors.New("client " + id + " is not connected")
+	}
+
+	_, err := management.Command("client-kill " + client.ClientId)
+	return err
+}
+
+// ManagementClient talks to the OpenVPN management interface over TCP or,
+// when the address is a path, a Unix socket
+type ManagementClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func DialManagement(address string, password string) (*ManagementClient, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, address, managementTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &ManagementClient{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	if len(password) > 0 {
+		if err := client.authenticate(password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// authenticate answers the password prompt, which OpenVPN sends without a
+// trailing newline
+func (m *ManagementClient) authenticate(password string) error {
+	m.conn.SetDeadline(time.Now().Add(managementTimeout))
+	defer m.conn.SetDeadline(time.Time{})
+
+	prompt := make([]byte, len(managementPasswordPrompt))
+	if _, err := io.ReadFull(m.reader, prompt); err != nil {
+		return err
+	}
+	if string(prompt) != managementPasswordPrompt {
+		return errors.New("unexpected management greeting " + string(prompt))
+	}
+
+	if _, err := m.conn.Write([]byte(password + "\n")); err != nil {
+		return err
+	}
+
+	for {
+		line, err := m.readLine()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "SUCCESS:") {
+			return nil
+		}
+		if strings.HasPrefix(line, "ERROR:") {
+			return ErrManagementPassword
+		}
+	}
+}
+
+func (m *ManagementClient) readLine() (string, error) {
+	line, err := m.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Command sends a command and returns its response. Single line responses are
+// returned as is, multi line responses without the terminating END.
+// Real-time notifications (lines starting with '>') are skipped
+func (m *ManagementClient) Command(command string) ([]string, error) {
+	m.conn.SetDeadline(time.Now().Add(managementTimeout))
+	defer m.conn.SetDeadline(time.Time{})
+
+	if _, err := m.conn.Write([]byte(command + "\n")); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := m.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+
+		if len(lines) == 0 {
+			if strings.HasPrefix(line, "SUCCESS:") {
+				return []string{line}, nil
+			}
+			if strings.HasPrefix(line, "ERROR:") {
+				return nil, errors.New("management command '" + command + "' failed: " + strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+			}
+		}
+
+		if line == "END" {
+			return lines, nil
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func (m *ManagementClient) Close() error {
+	m.conn.Write([]byte("quit\n"))
+	return m.conn.Close()
+}
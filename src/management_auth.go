@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	managementReconnectDelay = 5 * time.Second
+	managementEventPrefix    = ">CLIENT:"
+
+	// managementResponseLines buffers the response of a command, a status
+	// has a line for every client and route
+	managementResponseLines = 4096
+)
+
+// managementMode is set while authentications are answered through the
+// management interface, which is always asynchronous
+var managementMode bool
+
+// managementEvent is a >CLIENT notification together with its ENV block
+type managementEvent struct {
+	Kind     string
+	ClientId string
+	KeyId    string
+	Response string
+	Env      environment
+}
+
+// managementEventParser assembles >CLIENT notifications line by line
+type managementEventParser struct {
+	event *managementEvent
+}
+
+// parse returns the event once its ENV block is complete
+func (p *managementEventParser) parse(line string) *managementEvent {
+	if !strings.HasPrefix(line, managementEventPrefix) {
+		return nil
+	}
+	line = strings.TrimPrefix(line, managementEventPrefix)
+
+	if strings.HasPrefix(line, "ENV,") {
+		if p.event == nil {
+			return nil
+		}
+
+		entry := strings.TrimPrefix(line, "ENV,")
+		if entry == "END" {
+			event := p.event
+			p.event = nil
+			return event
+		}
+
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			p.event.Env[name] = value
+		}
+		return nil
+	}
+
+	// >CLIENT:CR_RESPONSE,{CID},{KID},{response}, the others carry CID and KID at most
+	fields := strings.SplitN(line, ",", 4)
+	event := &managementEvent{Kind: fields[0], Env: environment{}}
+	if len(fields) > 1 {
+		event.ClientId = fields[1]
+	}
+	if len(fields) > 2 {
+		event.KeyId = fields[2]
+	}
+	if len(fields) > 3 {
+		event.Response = fields[3]
+	}
+
+	switch event.Kind {
+	case "CONNECT", "REAUTH", "ESTABLISHED", "DISCONNECT", "CR_RESPONSE":
+		p.event = event
+	default:
+		// >CLIENT:ADDRESS has no ENV block
+		p.event = nil
+	}
+	return nil
+}
+
+// managementAuth answers management-client-auth events with the RADIUS
+// authentication and accounting used by the hooks
+type managementAuth struct {
+	repository *SQLiteRepository
+	client     *ManagementClient
+
+	// commands serializes commands, their response lines are read from responses
+	commands  sync.Mutex
+	responses chan string
+
+	// accounting keeps Start and Stop of a client in order
+	accounting chan *managementEvent
+	tasks      sync.WaitGroup
+}
+
+//code 5
+func runManagement(repository *SQLiteRepository) {
+	if len(config.OpenVPN.Management) == 0 {
+		log.Errorf("runManagement: OpenVPN.Management is not configured")
+		os.Exit(50)
+	}
+
+	managementMode = true
+
+	// The management interface is taken by this process, so the interim
+	// updates, the timeouts and the dynamic authorization run here as well
+	go interimUpdates(repository)
+
+	if len(config.Radius.DynamicAuthorization.Clients) > 0 {
+		conn, err := listenDynamicAuthorization()
+		if err != nil {
+			log.Errorf("runManagement: %s", err.Error())
+			os.Exit(51)
+		}
+		go func() {
+			if err := serveDynamicAuthorization(repository, conn); err != nil {
+				log.Errorf("runManagement: dynamic authorization stopped with %s", err.Error())
+			}
+		}()
+	}
+
+	for {
+		client, err := DialManagement(config.OpenVPN.Management, config.OpenVPN.ManagementPassword)
+		if err != nil {
+			log.Errorf("runManagement: unable to connect to %s: %s", config.OpenVPN.Management, err.Error())
+			time.Sleep(managementReconnectDelay)
+			continue
+		}
+
+		log.Info("runManagement: connected to " + config.OpenVPN.Management)
+
+		// OpenVPN serves a single management client, the other commands of
+		// this process share the connection
+		m := newManagementAuth(repository, client)
+		setSharedManagement(m)
+		err = m.serve()
+		setSharedManagement(nil)
+		log.Errorf("runManagement: connection lost %s", err.Error())
+
+		time.Sleep(managementReconnectDelay)
+	}
+}
+
+func newManagementAuth(repository *SQLiteRepository, client *ManagementClient) *managementAuth {
+	return &managementAuth{
+		repository: repository,
+		client:     client,
+		responses:  make(chan string, managementResponseLines),
+		accounting: make(chan *managementEvent, 256),
+	}
+}
+
+// serve reads the management interface until the connection is lost
+func (m *managementAuth) serve() error {
+	defer m.client.conn.Close()
+
+	m.tasks.Add(1)
+	go m.accountingWorker()
+	defer func() {
+		close(m.accounting)
+		m.tasks.Wait()
+	}()
+
+	var parser managementEventParser
+
+	for {
+		line, err := m.client.readLine()
+		if err != nil {
+			close(m.responses)
+			return err
+		}
+
+		if !strings.HasPrefix(line, ">") {
+			select {
+			case m.responses <- line:
+			default:
+				log.Warn("managementAuth: unexpected response " + line)
+			}
+			continue
+		}
+
+		event := parser.parse(line)
+		if event == nil {
+			continue
+		}
+
+		switch event.Kind {
+		case "CONNECT", "REAUTH", "CR_RESPONSE":
+			m.tasks.Add(1)
+			go func() {
+				defer m.tasks.Done()
+				m.authenticate(event)
+			}()
+		case "ESTABLISHED", "DISCONNECT":
+			m.accounting <- event
+		}
+	}
+}
+
+// command sends a command and waits for its SUCCESS or ERROR line
+func (m *managementAuth) command(command string) error {
+	_, err := m.Command(command)
+	return err
+}
+
+// Command sends a command on the connection and returns its response as
+// ManagementClient.Command does
+func (m *managementAuth) Command(command string) ([]string, error) {
+	m.commands.Lock()
+	defer m.commands.Unlock()
+
+	// Drop what is left of the response of a command that timed out
+	for len(m.responses) > 0 {
+		<-m.responses
+	}
+
+	if _, err := m.client.conn.Write([]byte(command + "\n")); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(managementTimeout)
+
+	var lines []string
+	for {
+		select {
+		case line, ok := <-m.responses:
+			if !ok {
+				return nil, errors.New("management connection closed")
+			}
+
+			if len(lines) == 0 {
+				if strings.HasPrefix(line, "SUCCESS:") {
+					return []string{line}, nil
+				}
+				if strings.HasPrefix(line, "ERROR:") {
+					return nil, errors.New("management command failed: " + strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+				}
+			}
+
+			if line == "END" {
+				return lines, nil
+			}
+			lines = append(lines, line)
+		case <-timeout:
+			return nil, errors.New("management command timed out")
+		}
+	}
+}
+
+// authenticate answers CONNECT, REAUTH and CR_RESPONSE. Challenges are
+// written by issueChallenge to the files OpenVPN would provide to a script
+// and passed on with client-deny or client-pending-auth
+func (m *managementAuth) authenticate(event *managementEvent) {
+	directory, err := os.MkdirTemp("", "ovpn-radius-")
+	if err != nil {
+		log.Errorf("managementAuth: unable to create challenge directory %s", err.Error())
+		m.deny(event, "internal error", "")
+		return
+	}
+	defer os.RemoveAll(directory)
+
+	reasonFile := filepath.Join(directory, "auth_failed_reason")
+	pendingFile := filepath.Join(directory, "auth_pending")
+
+	event.Env["auth_failed_reason_file"] = reasonFile
+	if strings.Contains(event.Env.Get("IV_SSO"), "crtext") {
+		event.Env["auth_pending_file"] = pendingFile
+	}
+
+	var exitCode int
+	if event.Kind == "CR_RESPONSE" {
+		exitCode = respondToChallenge(m.repository, event.Env, event.Response)
+	} else {
+		exitCode = authenticate(m.repository, event.Env, event.Env.Get("username"), event.Env.Get("password"))
+	}
+
+	switch exitCode {
+	case 0:
+		m.accept(event)
+	case 2:
+		pending, err := os.ReadFile(pendingFile)
+		if err != nil {
+			log.Errorf("managementAuth: unable to read pending challenge %s", err.Error())
+			m.deny(event, "internal error", "")
+			return
+		}
+
+		// auth_pending_file holds the timeout, the method and the challenge
+		lines := strings.Split(strings.TrimRight(string(pending), "\n"), "\n")
+		timeout, _ := strconv.Atoi(lines[0])
+		if len(lines) < 3 || timeout <= 0 {
+			log.Errorf("managementAuth: malformed pending challenge %q", pending)
+			m.deny(event, "internal error", "")
+			return
+		}
+
+		command := "client-pending-auth " + event.ClientId + " " + event.KeyId + " " + managementQuote(lines[2]) + " " + strconv.Itoa(timeout)
+		if err := m.command(command); err != nil {
+			log.Errorf("managementAuth: unable to send pending challenge to client %s: %s", event.ClientId, err.Error())
+		}
+	case 39:
+		reason, err := os.ReadFile(reasonFile)
+		if err != nil {
+			log.Errorf("managementAuth: unable to read challenge %s", err.Error())
+			m.deny(event, "internal error", "")
+			return
+		}
+		m.deny(event, "challenge", string(reason))
+	default:
+		m.deny(event, "RADIUS authentication failed with code "+strconv.Itoa(exitCode), "")
+	}
+}
+
+// accept lets the client in, with the client-connect directives of its
+// session when there are any
+func (m *managementAuth) accept(event *managementEvent) {
+	directives, err := connectConfig(m.repository, event.Env)
+	if err != nil {
+		log.Errorf("managementAuth: unable to read client config %s", err.Error())
+		m.deny(event, "internal error", "")
+		return
+	}
+
+	command := "client-auth-nt " + event.ClientId + " " + event.KeyId
+	if len(directives) > 0 {
+		command = "client-auth " + event.ClientId + " " + event.KeyId + "\n" + strings.Join(directives, "\n") + "\nEND"
+	}
+
+	if err := m.command(command); err != nil {
+		log.Errorf("managementAuth: unable to accept client %s: %s", event.ClientId, err.Error())
+	}
+}
+
+// deny rejects the client. The client reason, such as a CRV1 challenge, is
+// sent to the client in AUTH_FAILED
+func (m *managementAuth) deny(event *managementEvent, reason string, clientReason string) {
+	command := "client-deny " + event.ClientId + " " + event.KeyId + " " + managementQuote(reason)
+	if len(clientReason) > 0 {
+		command += " " + managementQuote(clientReason)
+	}
+
+	if err := m.command(command); err != nil {
+		log.Errorf("managementAuth: unable to deny client %s: %s", event.ClientId, err.Error())
+	}
+}
+
+// accountingWorker sends Start for ESTABLISHED and Stop for DISCONNECT.
+// Clients whose Start fails are killed, as a failing client-connect script
+// would have rejected them
+func (m *managementAuth) accountingWorker() {
+	defer m.tasks.Done()
+
+	for event := range m.accounting {
+		if event.Kind == "DISCONNECT" {
+			accounting(m.repository, event.Env, "stop")
+			continue
+		}
+
+		if exitCode := accounting(m.repository, event.Env, "start"); exitCode != 0 {
+			log.Errorf("managementAuth: killing client %s after accounting failed with code %d", event.ClientId, exitCode)
+			if err := m.command("client-kill " + event.ClientId); err != nil {
+				log.Errorf("managementAuth: unable to kill client %s: %s", event.ClientId, err.Error())
+			}
+		}
+	}
+}
+
+// managementQuote quotes a command argument for the management interface
+func managementQuote(value string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(value) + "\""
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagementEventParser(t *testing.T) {
+	var parser managementEventParser
+
+	lines := []string{
+		">INFO:OpenVPN Management Interface Version 5",
+		">CLIENT:ADDRESS,3,10.8.0.6,1",
+		">CLIENT:CR_RESPONSE,7,1,MTIzNDU2",
+		">CLIENT:ENV,untrusted_ip=192.0.2.10",
+		">CLIENT:ENV,password=a=b",
+		">CLIENT:ENV,END",
+	}
+
+	var events []*managementEvent
+	for _, line := range lines {
+		if event := parser.parse(line); event != nil {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected one event, got %d", len(events))
+	}
+	event := events[0]
+	if event.Kind != "CR_RESPONSE" || event.ClientId != "7" || event.KeyId != "1" || event.Response != "MTIzNDU2" {
+		t.Fatalf("Unexpected event: %+v", event)
+	}
+	if event.Env.Get("untrusted_ip") != "192.0.2.10" || event.Env.Get("password") != "a=b" {
+		t.Fatalf("Unexpected event environment: %+v", event.Env)
+	}
+}
+
+// startTestManagement accepts one management connection, checks the password
+// and passes the received commands on, answering each with SUCCESS
+func startTestManagement(t *testing.T, password string) (string, chan net.Conn, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	connections := make(chan net.Conn, 1)
+	commands := make(chan string, 16)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte(managementPasswordPrompt))
+		if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != password {
+			conn.Write([]byte("ERROR: bad password\n"))
+			conn.Close()
+			return
+		}
+		conn.Write([]byte("SUCCESS: password is correct\n>INFO:OpenVPN Management Interface Version 5\n"))
+		connections <- conn
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			commands <- strings.TrimSpace(line)
+			conn.Write([]byte("SUCCESS: command succeeded\n"))
+		}
+	}()
+
+	return listener.Addr().String(), connections, commands
+}
+
+func expectCommand(t *testing.T, commands chan string, prefix string) string {
+	select {
+	case command := <-commands:
+		if !strings.HasPrefix(command, prefix) {
+			t.Fatalf("Expected command %q, got %q", prefix, command)
+		}
+		return command
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for %q", prefix)
+	}
+	return ""
+}
+
+func TestManagementAuth(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	secret := "s3cr3t"
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		if username, _ := request.GetString(AttrUserName); username == "alice" {
+			return encodeTestResponse(t, &Packet{Code: CodeAccessAccept}, request, secret)
+		}
+		challenge := &Packet{Code: CodeAccessChallenge}
+		challenge.AddString(AttrReplyMessage, "Enter your OTP")
+		challenge.AddString(AttrState, "radius-state")
+		return encodeTestResponse(t, challenge, request, secret)
+	})
+
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+	config.Radius.Authentication = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret}}
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: closedUDPAddress(t), Secret: secret}}
+	config.Radius.Deadline = 1
+
+	address, connections, commands := startTestManagement(t, "management")
+
+	client, err := DialManagement(address, "management")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- newManagementAuth(repository, client).serve() }()
+
+	conn := <-connections
+	conn.Write([]byte(">CLIENT:CONNECT,1,0\n" +
+		">CLIENT:ENV,username=alice\n>CLIENT:ENV,password=secret\n" +
+		">CLIENT:ENV,untrusted_ip=192.0.2.10\n>CLIENT:ENV,untrusted_port=50000\n>CLIENT:ENV,END\n"))
+	expectCommand(t, commands, "client-auth-nt 1 0")
+
+	conn.Write([]byte(">CLIENT:CONNECT,2,0\n" +
+		">CLIENT:ENV,username=bob\n>CLIENT:ENV,password=secret\n" +
+		">CLIENT:ENV,untrusted_ip=192.0.2.11\n>CLIENT:ENV,untrusted_port=50000\n>CLIENT:ENV,END\n"))
+	deny := expectCommand(t, commands, "client-deny 2 0 \"challenge\" \"CRV1:R,E:")
+	if !strings.HasSuffix(deny, ":Ym9i:Enter your OTP\"") {
+		t.Fatalf("Unexpected challenge: %q", deny)
+	}
+
+	// The accounting server is down, so the Start is queued and the client stays
+	conn.Write([]byte(">CLIENT:ESTABLISHED,1\n" +
+		">CLIENT:ENV,untrusted_ip=192.0.2.10\n>CLIENT:ENV,untrusted_port=50000\n" +
+		">CLIENT:ENV,ifconfig_pool_remote_ip=10.8.0.6\n>CLIENT:ENV,END\n"))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if queued, _ := repository.QueuedAccounting(); len(queued) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the queued Start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case command := <-commands:
+		t.Fatalf("Unexpected command %q", command)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("serve did not return after the connection was closed")
+	}
+}
+
+func TestSharedManagement(t *testing.T) {
+	local, remote := net.Pipe()
+	m := newManagementAuth(nil, &ManagementClient{conn: local, reader: bufio.NewReader(local)})
+
+	done := make(chan error)
+	go func() { done <- m.serve() }()
+
+	// OpenVPN interleaves notifications with the response of a command
+	go func() {
+		reader := bufio.NewReader(remote)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.TrimSpace(line) {
+			case "status 2":
+				remote.Write([]byte("TITLE,OpenVPN 2.6\n>BYTECOUNT_CLI:1,100,200\nCLIENT_LIST,alice,192.0.2.10:50000\nEND\n"))
+			case "kill 192.0.2.10:50000":
+				remote.Write([]byte("SUCCESS: common name 'alice' found, 1 client(s) killed\n"))
+			default:
+				remote.Write([]byte("ERROR: unknown command\n"))
+			}
+		}
+	}()
+
+	setSharedManagement(m)
+	defer setSharedManagement(nil)
+
+	management, release, err := openManagement()
+	if err != nil {
+		t.Fatalf("Failed to open the shared management connection: %v", err)
+	}
+	defer release()
+
+	lines, err := management.Command("status 2")
+	if err != nil || len(lines) != 2 || lines[1] != "CLIENT_LIST,alice,192.0.2.10:50000" {
+		t.Fatalf("Unexpected status %q: %v", lines, err)
+	}
+	if _, err := management.Command("kill 192.0.2.10:50000"); err != nil {
+		t.Fatalf("Failed to kill: %v", err)
+	}
+	if _, err := management.Command("bogus"); err == nil {
+		t.Fatalf("Expected the command to fail")
+	}
+
+	remote.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("serve did not return after the connection was closed")
+	}
+}
+
+func TestManagementQuote(t *testing.T) {
+	if quoted := managementQuote(`say "hi" \o/`); quoted != `"say \"hi\" \\o/"` {
+		t.Fatalf("Unexpected quoting: %s", quoted)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//code 12
+func nasAccounting(statusType uint32, repository *SQLiteRepository) {
+	// A failing up script stops OpenVPN from starting, so a RADIUS outage is only logged
+	if exitCode := accountingOnOff(repository, statusType); exitCode != 0 {
+		log.Warnf("nasAccounting: finished with code %d", exitCode)
+	}
+	os.Exit(0)
+}
+
+// accountingOnOff reports the start or the stop of the OpenVPN server with
+// Accounting-On or Accounting-Off (RFC 2866 section 5.1). Sessions that are
+// still stored when the server starts were never stopped, as OpenVPN did not
+// run client-disconnect, and are stopped first
+func accountingOnOff(repository *SQLiteRepository, statusType uint32) int {
+	exitCode := 0
+
+	if statusType == AcctStatusTypeAccountingOn {
+		exitCode = stopOrphanSessions(repository)
+	}
+
+	sessionId, err := newSessionId()
+	if err != nil {
+		log.Errorf("accountingOnOff: Error: %s", err.Error())
+		return 121
+	}
+
+	request, err := NewPacket(CodeAccountingRequest)
+	if err != nil {
+		log.Errorf("accountingOnOff: Error: %s", err.Error())
+		return 121
+	}
+
+	request.AddInteger(AttrAcctStatusType, statusType)
+	request.AddString(AttrAcctSessionId, sessionId)
+	if err := addServerInfo(request); err != nil {
+		log.Errorf("accountingOnOff: Error: %s", err.Error())
+		return 121
+	}
+
+	if err := sendAccountingRequest(repository, request); err != nil {
+		log.Errorf("accountingOnOff: unable to send %s: %s", acctStatusTypeName(statusType), err.Error())
+		return 122
+	}
+
+	log.Info("accountingOnOff: sent " + acctStatusTypeName(statusType))
+
+	return exitCode
+}
+
+// stopOrphanSessions sends Stop with Acct-Terminate-Cause NAS-Reboot for the
+// started sessions left in the database and removes every stored session
+func stopOrphanSessions(repository *SQLiteRepository) int {
+	clients, err := repository.All()
+	if err != nil {
+		log.Errorf("stopOrphanSessions: unable to read sessions %s", err.Error())
+		return 120
+	}
+
+	exitCode := 0
+
+	// Once a Stop goes unanswered the others are queued right away, so an
+	// accounting outage does not hold up the start of OpenVPN for every session
+	send := true
+
+	for _, client := range clients {
+		if client.StartedAt > 0 && len(client.SessionId) > 0 {
+			unanswered, err := stopOrphanSession(repository, &client, send)
+			if unanswered {
+				send = false
+			}
+			if err != nil {
+				log.Errorf("stopOrphanSessions: Stop for %s failed: %s", client.Id, err.Error())
+				exitCode = 123
+			} else {
+				log.Info("stopOrphanSessions: stopped session of user '" + client.CommonName + "' with Id " + client.Id)
+			}
+		}
+
+		// The row would otherwise be taken for the next client with the same address
+		if err := repository.Delete(client.Id); err != nil {
+			log.Errorf("stopOrphanSessions: unable to delete %s: %s", client.Id, err.Error())
+			exitCode = 120
+		}
+	}
+
+	return exitCode
+}
+
+// stopOrphanSession sends or queues the Stop of a session. The session is taken
+// to end with its last Interim-Update, the time OpenVPN was down is not billed
+func stopOrphanSession(repository *SQLiteRepository, client *OVPNClient, send bool) (bool, error) {
+	request, err := newAccountingRequest(AcctStatusTypeStop, client, client.IpAddress)
+	if err != nil {
+		return false, err
+	}
+
+	endedAt := client.StartedAt
+	if client.LastInterimAt > endedAt {
+		endedAt = client.LastInterimAt
+	}
+
+	// The traffic counters were lost with the OpenVPN process
+	request.AddInteger(AttrAcctSessionTime, uint32(endedAt-client.StartedAt))
+	request.AddInteger(AttrEventTimestamp, uint32(endedAt))
+	request.AddInteger(AttrAcctTerminateCause, AcctTerminateCauseNASReboot)
+
+	return sendOrQueueAccountingRequest(repository, request, send)
+}
+
+func acctStatusTypeName(statusType uint32) string {
+	if statusType == AcctStatusTypeAccountingOn {
+		return "Accounting-On"
+	}
+	return "Accounting-Off"
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAccountingOnOff(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", SessionId: "65A1F2C3-9F86D081884C7D65", StartedAt: 1700000000, LastInterimAt: 1700000300})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", SessionId: "65A1F2C3-0000000000000000"})
+
+	secret := "s3cr3t"
+	var mutex sync.Mutex
+	var received []*Packet
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		mutex.Lock()
+		received = append(received, request)
+		mutex.Unlock()
+		return encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	})
+
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret}}
+	config.Radius.Deadline = 1
+
+	if exitCode := accountingOnOff(repository, AcctStatusTypeAccountingOn); exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", exitCode)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected Stop and Accounting-On, got %d requests", len(received))
+	}
+
+	stop := received[0]
+	if statusType, _ := stop.GetInteger(AttrAcctStatusType); statusType != AcctStatusTypeStop {
+		t.Fatalf("Expected Stop for the orphan session, got %d", statusType)
+	}
+	if sessionId, _ := stop.GetString(AttrAcctSessionId); sessionId != "65A1F2C3-9F86D081884C7D65" {
+		t.Fatalf("Unexpected Stop session %q", sessionId)
+	}
+	if cause, _ := stop.GetInteger(AttrAcctTerminateCause); cause != AcctTerminateCauseNASReboot {
+		t.Fatalf("Expected NAS-Reboot terminate cause, got %d", cause)
+	}
+	// The session ends with its last Interim-Update, not when OpenVPN came back
+	sessionTime, _ := stop.GetInteger(AttrAcctSessionTime)
+	timestamp, _ := stop.GetInteger(AttrEventTimestamp)
+	if sessionTime != 300 || timestamp != 1700000300 {
+		t.Fatalf("Expected the session to end with its last Interim-Update, got %d seconds at %d", sessionTime, timestamp)
+	}
+
+	on := received[1]
+	if statusType, _ := on.GetInteger(AttrAcctStatusType); statusType != AcctStatusTypeAccountingOn {
+		t.Fatalf("Expected Accounting-On, got %d", statusType)
+	}
+	if identifier, _ := on.GetString(AttrNASIdentifier); identifier != config.ServerInfo.Identifier {
+		t.Fatalf("Accounting-On must carry the NAS identity, got %q", identifier)
+	}
+
+	if clients, _ := repository.All(); len(clients) != 0 {
+		t.Fatalf("Expected orphan sessions to be removed, got %+v", clients)
+	}
+}
+
+func TestStopOrphanSessionsOutage(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", SessionId: "65A1F2C3-0000000000000001", StartedAt: 1700000000})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", SessionId: "65A1F2C3-0000000000000002", StartedAt: 1700000000})
+	repository.Create(OVPNClient{Id: "192.0.2.12:50000", CommonName: "carol", SessionId: "65A1F2C3-0000000000000003", StartedAt: 1700000000})
+
+	var mutex sync.Mutex
+	received := 0
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		mutex.Lock()
+		received++
+		mutex.Unlock()
+		return nil
+	})
+
+	radius := config.Radius
+	defer func() { config.Radius = radius }()
+	retries := 0
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: "s3cr3t", Timeout: 0.1, Retries: &retries}}
+	config.Radius.Deadline = 1
+
+	if exitCode := stopOrphanSessions(repository); exitCode != 0 {
+		t.Fatalf("Expected exit code 0, got %d", exitCode)
+	}
+
+	// Only the first Stop waits for the servers, the others are queued
+	mutex.Lock()
+	defer mutex.Unlock()
+	if received != 1 {
+		t.Fatalf("Expected a single attempt, got %d", received)
+	}
+	if entries, _ := repository.QueuedAccounting(); len(entries) != 3 {
+		t.Fatalf("Expected every Stop to be queued, got %d", len(entries))
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !plugin
+
+package main
+
+// nativePlugin is true when built as the OpenVPN plugin shared library
+const nativePlugin = false
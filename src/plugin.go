@@ -0,0 +1,264 @@
+//go:build plugin
+
+package main
+
+/*
+#include <stdlib.h>
+
+// Subset of openvpn-plugin.h for the plugin API v3. Only the leading members
+// of the argument structures are declared, they are the same in every
+// OPENVPN_PLUGINv3_STRUCTVER. The OpenVPN version of the open arguments is
+// present from structure version 4 (OpenVPN 2.4)
+
+#define OPENVPN_PLUGIN_UP                    0
+#define OPENVPN_PLUGIN_DOWN                  1
+#define OPENVPN_PLUGIN_AUTH_USER_PASS_VERIFY 5
+#define OPENVPN_PLUGIN_CLIENT_DISCONNECT     7
+#define OPENVPN_PLUGIN_CLIENT_CONNECT_V2     9
+#define OPENVPN_PLUGIN_CLIENT_CONNECT_DEFER_V2 14
+#define OPENVPN_PLUGIN_CLIENT_CRRESPONSE     15
+
+#define OPENVPN_PLUGIN_FUNC_SUCCESS  0
+#define OPENVPN_PLUGIN_FUNC_ERROR    1
+#define OPENVPN_PLUGIN_FUNC_DEFERRED 2
+
+typedef void *openvpn_plugin_handle_t;
+
+struct openvpn_plugin_string_list {
+	struct openvpn_plugin_string_list *next;
+	char *name;
+	char *value;
+};
+
+struct openvpn_plugin_args_open_in {
+	const int type_mask;
+	const char **const argv;
+	const char **const envp;
+	void *callbacks;
+	const int ssl_api;
+	const char *ovpn_version;
+	const unsigned int ovpn_version_major;
+	const unsigned int ovpn_version_minor;
+	const char *const ovpn_version_patch;
+};
+
+struct openvpn_plugin_args_open_return {
+	int type_mask;
+	openvpn_plugin_handle_t handle;
+	struct openvpn_plugin_string_list **return_list;
+};
+
+struct openvpn_plugin_args_func_in {
+	const int type;
+	const char **const argv;
+	const char **const envp;
+	openvpn_plugin_handle_t handle;
+};
+
+struct openvpn_plugin_args_func_return {
+	struct openvpn_plugin_string_list **return_list;
+};
+*/
+import "C"
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// nativePlugin is true when built as the OpenVPN plugin shared library
+const nativePlugin = true
+
+var (
+	pluginRepository *SQLiteRepository
+	pluginHandle     unsafe.Pointer
+
+	// pluginTasks tracks the deferred work still running in the background
+	pluginTasks sync.WaitGroup
+
+	// pluginConnects holds the client-connects deferred by OpenVPN 2.5 and
+	// newer, older versions wait for the client-connect
+	pluginConnects      deferredConnects
+	pluginDeferConnects bool
+)
+
+//export openvpn_plugin_min_version_required_v1
+func openvpn_plugin_min_version_required_v1() C.int {
+	return 3
+}
+
+// openvpn_plugin_open_v3 loads the configuration named by the first plugin
+// argument, or the default one, and keeps the database open until OpenVPN
+// closes the plugin
+//
+//export openvpn_plugin_open_v3
+func openvpn_plugin_open_v3(version C.int, arguments *C.struct_openvpn_plugin_args_open_in, retptr *C.struct_openvpn_plugin_args_open_return) C.int {
+	path := configFile
+	if argv := cStrings(arguments.argv); len(argv) > 1 {
+		path = argv[1]
+	}
+
+	if err := loadConfig(path); err != nil {
+		log.Errorf("openvpn_plugin_open_v3: failed to load %s with %s", path, err)
+		return C.OPENVPN_PLUGIN_FUNC_ERROR
+	}
+
+	repository, err := InitializeDatabase(false)
+	if err != nil {
+		log.Errorf("openvpn_plugin_open_v3: error %s.", err)
+		return C.OPENVPN_PLUGIN_FUNC_ERROR
+	}
+	pluginRepository = repository
+
+	pluginDeferConnects = version >= 4 && (arguments.ovpn_version_major > 2 || (arguments.ovpn_version_major == 2 && arguments.ovpn_version_minor >= 5))
+
+	typeMask := pluginMask(C.OPENVPN_PLUGIN_AUTH_USER_PASS_VERIFY) | pluginMask(C.OPENVPN_PLUGIN_CLIENT_CRRESPONSE)
+	if !config.Radius.AuthenticationOnly {
+		typeMask |= pluginMask(C.OPENVPN_PLUGIN_UP) | pluginMask(C.OPENVPN_PLUGIN_DOWN)
+		typeMask |= pluginMask(C.OPENVPN_PLUGIN_CLIENT_CONNECT_V2) | pluginMask(C.OPENVPN_PLUGIN_CLIENT_DISCONNECT)
+		if pluginDeferConnects {
+			typeMask |= pluginMask(C.OPENVPN_PLUGIN_CLIENT_CONNECT_DEFER_V2)
+		}
+	}
+
+	// OpenVPN requires a non-NULL handle, the state itself stays in Go
+	pluginHandle = C.malloc(1)
+
+	retptr.type_mask = typeMask
+	retptr.handle = C.openvpn_plugin_handle_t(pluginHandle)
+
+	log.Info("openvpn_plugin_open_v3: plugin loaded with config " + path)
+	return C.OPENVPN_PLUGIN_FUNC_SUCCESS
+}
+
+//export openvpn_plugin_func_v3
+func openvpn_plugin_func_v3(version C.int, arguments *C.struct_openvpn_plugin_args_func_in, retptr *C.struct_openvpn_plugin_args_func_return) C.int {
+	env := parseEnvironment(cStrings(arguments.envp))
+
+	switch arguments._type {
+	case C.OPENVPN_PLUGIN_AUTH_USER_PASS_VERIFY:
+		username := env.Get("username")
+		password := env.Get("password")
+		if len(username) <= 0 || len(password) <= 0 {
+			log.Errorf("openvpn_plugin_func_v3: unable to authenticate username or password is null")
+			return C.OPENVPN_PLUGIN_FUNC_ERROR
+		}
+
+		return pluginDefer(env, func() int {
+			return authenticate(pluginRepository, env, username, password)
+		})
+	case C.OPENVPN_PLUGIN_CLIENT_CRRESPONSE:
+		return pluginDefer(env, func() int {
+			return respondToChallenge(pluginRepository, env, env.Get("crresponse"))
+		})
+	case C.OPENVPN_PLUGIN_UP, C.OPENVPN_PLUGIN_DOWN:
+		// As with the up and down scripts a RADIUS outage must not stop OpenVPN
+		statusType := AcctStatusTypeAccountingOn
+		if arguments._type == C.OPENVPN_PLUGIN_DOWN {
+			statusType = AcctStatusTypeAccountingOff
+		}
+		accountingOnOff(pluginRepository, statusType)
+		return C.OPENVPN_PLUGIN_FUNC_SUCCESS
+	case C.OPENVPN_PLUGIN_CLIENT_CONNECT_V2:
+		// The Start runs in the background and OpenVPN polls for its result
+		// through CLIENT_CONNECT_DEFER_V2
+		if pluginDeferConnects {
+			pluginConnects.start(&pluginTasks, env.clientId(), func() (int, []string) {
+				return clientConnect(pluginRepository, env)
+			})
+			return C.OPENVPN_PLUGIN_FUNC_DEFERRED
+		}
+
+		exitCode, directives := clientConnect(pluginRepository, env)
+		return pluginConnectResult(retptr, exitCode, directives)
+	case C.OPENVPN_PLUGIN_CLIENT_CONNECT_DEFER_V2:
+		connect, done := pluginConnects.result(env.clientId())
+		if !done {
+			return C.OPENVPN_PLUGIN_FUNC_DEFERRED
+		}
+		return pluginConnectResult(retptr, connect.exitCode, connect.directives)
+	case C.OPENVPN_PLUGIN_CLIENT_DISCONNECT:
+		pluginConnects.forget(env.clientId())
+
+		// OpenVPN ignores the result, so the Stop does not hold up the event loop
+		pluginTasks.Add(1)
+		go func() {
+			defer pluginTasks.Done()
+			accounting(pluginRepository, env, "stop")
+		}()
+		return C.OPENVPN_PLUGIN_FUNC_SUCCESS
+	default:
+		log.Errorf("openvpn_plugin_func_v3: plugin type %d is unknown.", int(arguments._type))
+		return C.OPENVPN_PLUGIN_FUNC_ERROR
+	}
+}
+
+//export openvpn_plugin_close_v1
+func openvpn_plugin_close_v1(handle C.openvpn_plugin_handle_t) {
+	pluginTasks.Wait()
+
+	if pluginRepository != nil {
+		pluginRepository.Close()
+		pluginRepository = nil
+	}
+
+	C.free(pluginHandle)
+	pluginHandle = nil
+
+	log.Info("openvpn_plugin_close_v1: plugin closed")
+}
+
+// pluginDefer runs an authentication in the background and reports its
+// result through auth_control_file. Without an auth_control_file the
+// authentication blocks OpenVPN until it is finished
+func pluginDefer(env environment, authentication func() int) C.int {
+	if len(env.Get("auth_control_file")) == 0 {
+		return pluginResult(authentication())
+	}
+
+	runDeferred(&pluginTasks, env, authentication)
+	return C.OPENVPN_PLUGIN_FUNC_DEFERRED
+}
+
+// pluginResult converts the exit code of a script into a plugin return value
+func pluginResult(exitCode int) C.int {
+	if exitCode == 0 {
+		return C.OPENVPN_PLUGIN_FUNC_SUCCESS
+	}
+	return C.OPENVPN_PLUGIN_FUNC_ERROR
+}
+
+// pluginConnectResult hands the client-connect directives to OpenVPN
+func pluginConnectResult(retptr *C.struct_openvpn_plugin_args_func_return, exitCode int, directives []string) C.int {
+	if exitCode != 0 {
+		return pluginResult(exitCode)
+	}
+	if len(directives) > 0 && retptr.return_list != nil {
+		*retptr.return_list = pluginStringList("config", strings.Join(directives, "\n")+"\n")
+	}
+	return C.OPENVPN_PLUGIN_FUNC_SUCCESS
+}
+
+// pluginStringList allocates a single entry return list, which OpenVPN frees
+func pluginStringList(name string, value string) *C.struct_openvpn_plugin_string_list {
+	list := (*C.struct_openvpn_plugin_string_list)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_openvpn_plugin_string_list{}))))
+	list.name = C.CString(name)
+	list.value = C.CString(value)
+	return list
+}
+
+func pluginMask(pluginType C.int) C.int {
+	return 1 << pluginType
+}
+
+// cStrings copies a NULL terminated array of C strings
+func cStrings(list **C.char) []string {
+	var values []string
+	for ; list != nil && *list != nil; list = (**C.char)(unsafe.Add(unsafe.Pointer(list), unsafe.Sizeof(*list))) {
+		values = append(values, C.GoString(*list))
+	}
+	return values
+}
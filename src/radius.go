@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+type PacketCode byte
+
+// RADIUS packet codes (RFC 2865, RFC 2866)
+const (
+	CodeAccessRequest      PacketCode = 1
+	CodeAccessAccept       PacketCode = 2
+	CodeAccessReject       PacketCode = 3
+	CodeAccountingRequest  PacketCode = 4
+	CodeAccountingResponse PacketCode = 5
+	CodeAccessChallenge    PacketCode = 11
+	CodeDisconnectRequest  PacketCode = 40
+	CodeDisconnectACK      PacketCode = 41
+	CodeDisconnectNAK      PacketCode = 42
+	CodeCoARequest         PacketCode = 43
+	CodeCoAACK             PacketCode = 44
+	CodeCoANAK             PacketCode = 45
+)
+
+var packetCodeNames = map[PacketCode]string{
+	CodeAccessRequest:      "Access-Request",
+	CodeAccessAccept:       "Access-Accept",
+	CodeAccessReject:       "Access-Reject",
+	CodeAccountingRequest:  "Accounting-Request",
+	CodeAccountingResponse: "Accounting-Response",
+	CodeAccessChallenge:    "Access-Challenge",
+	CodeDisconnectRequest:  "Disconnect-Request",
+	CodeDisconnectACK:      "Disconnect-ACK",
+	CodeDisconnectNAK:      "Disconnect-NAK",
+	CodeCoARequest:         "CoA-Request",
+	CodeCoAACK:             "CoA-ACK",
+	CodeCoANAK:             "CoA-NAK",
+}
+
+func (c PacketCode) String() string {
+	if name, ok := packetCodeNames[c]; ok {
+		return name
+	}
+	return "Code-" + strconv.Itoa(int(c))
+}
+
+type AttributeType byte
+
+// RADIUS attribute types (RFC 2865, RFC 2866, RFC 2869, RFC 3162, RFC 5176,
+// RFC 6911)
+const (
+	AttrUserName             AttributeType = 1
+	AttrUserPassword         AttributeType = 2
+	AttrNASIPAddress         AttributeType = 4
+	AttrNASPort              AttributeType = 5
+	AttrServiceType          AttributeType = 6
+	AttrFramedProtocol       AttributeType = 7
+	AttrFramedIPAddress      AttributeType = 8
+	AttrFramedIPNetmask      AttributeType = 9
+	AttrFilterId             AttributeType = 11
+	AttrReplyMessage         AttributeType = 18
+	AttrFramedRoute          AttributeType = 22
+	AttrState                AttributeType = 24
+	AttrClass                AttributeType = 25
+	AttrVendorSpecific       AttributeType = 26
+	AttrSessionTimeout       AttributeType = 27
+	AttrIdleTimeout          AttributeType = 28
+	AttrTerminationAction    AttributeType = 29
+	AttrCalledStationId      AttributeType = 30
+	AttrCallingStationId     AttributeType = 31
+	AttrNASIdentifier        AttributeType = 32
+	AttrProxyState           AttributeType = 33
+	AttrAcctStatusType       AttributeType = 40
+	AttrAcctDelayTime        AttributeType = 41
+	AttrAcctInputOctets      AttributeType = 42
+	AttrAcctOutputOctets     AttributeType = 43
+	AttrAcctSessionId        AttributeType = 44
+	AttrAcctAuthentic        AttributeType = 45
+	AttrAcctSessionTime      AttributeType = 46
+	AttrAcctInputPackets     AttributeType = 47
+	AttrAcctOutputPackets    AttributeType = 48
+	AttrAcctTerminateCause   AttributeType = 49
+	AttrAcctMultiSessionId   AttributeType = 50
+	AttrAcctInputGigawords   AttributeType = 52
+	AttrAcctOutputGigawords  AttributeType = 53
+	AttrEventTimestamp       AttributeType = 55
+	AttrNASPortType          AttributeType = 61
+	AttrPrompt               AttributeType = 76
+	AttrMessageAuthenticator AttributeType = 80
+	AttrAcctInterimInterval  AttributeType = 85
+	AttrNASPortId            AttributeType = 87
+	AttrNASIPv6Address       AttributeType = 95
+	AttrFramedInterfaceId    AttributeType = 96
+	AttrFramedIPv6Prefix     AttributeType = 97
+	AttrFramedIPv6Route      AttributeType = 99
+	AttrErrorCause           AttributeType = 101
+	AttrFramedIPv6Address    AttributeType = 168
+)
+
+// Service-Type values (RFC 2865, RFC 5176)
+const (
+	ServiceTypeAuthorizeOnly uint32 = 17
+)
+
+// Termination-Action values (RFC 2865)
+const (
+	TerminationActionDefault       uint32 = 0
+	TerminationActionRADIUSRequest uint32 = 1
+)
+
+// Framed-Protocol values (RFC 2865)
+const (
+	FramedProtocolPPP uint32 = 1
+)
+
+// Prompt values (RFC 2869)
+const (
+	PromptNoEcho uint32 = 0
+	PromptEcho   uint32 = 1
+)
+
+// Acct-Status-Type values (RFC 2866)
+const (
+	AcctStatusTypeStart         uint32 = 1
+	AcctStatusTypeStop          uint32 = 2
+	AcctStatusTypeInterimUpdate uint32 = 3
+	AcctStatusTypeAccountingOn  uint32 = 7
+	AcctStatusTypeAccountingOff uint32 = 8
+)
+
+// Acct-Terminate-Cause values (RFC 2866)
+const (
+	AcctTerminateCauseUserRequest    uint32 = 1
+	AcctTerminateCauseLostCarrier    uint32 = 2
+	AcctTerminateCauseIdleTimeout    uint32 = 4
+	AcctTerminateCauseSessionTimeout uint32 = 5
+	AcctTerminateCauseAdminReset     uint32 = 6
+	AcctTerminateCauseAdminReboot    uint32 = 7
+	AcctTerminateCausePortError      uint32 = 8
+	AcctTerminateCauseNASRequest     uint32 = 10
+	AcctTerminateCauseNASReboot      uint32 = 11
+
+	// RFC 3580
+	AcctTerminateCauseReauthenticationFailure uint32 = 20
+)
+
+// Error-Cause values (RFC 5176)
+const (
+	ErrorCauseUnsupportedAttribute        uint32 = 401
+	ErrorCauseMissingAttribute            uint32 = 402
+	ErrorCauseNASIdentificationMismatch   uint32 = 403
+	ErrorCauseInvalidRequest              uint32 = 404
+	ErrorCauseUnsupportedService          uint32 = 405
+	ErrorCauseUnsupportedExtension        uint32 = 406
+	ErrorCauseInvalidAttributeValue       uint32 = 407
+	ErrorCauseAdministrativelyProhibited  uint32 = 501
+	ErrorCauseSessionContextNotFound      uint32 = 503
+	ErrorCauseSessionContextNotRemovable  uint32 = 504
+	ErrorCauseResourcesUnavailable        uint32 = 506
+	ErrorCauseMultipleSessionNotSupported uint32 = 508
+)
+
+var attributeNames = map[AttributeType]string{
+	AttrUserName:             "User-Name",
+	AttrUserPassword:         "User-Password",
+	AttrNASIPAddress:         "NAS-IP-Address",
+	AttrNASPort:              "NAS-Port",
+	AttrServiceType:          "Service-Type",
+	AttrFramedProtocol:       "Framed-Protocol",
+	AttrFramedIPAddress:      "Framed-IP-Address",
+	AttrFramedIPNetmask:      "Framed-IP-Netmask",
+	AttrFilterId:             "Filter-Id",
+	AttrReplyMessage:         "Reply-Message",
+	AttrFramedRoute:          "Framed-Route",
+	AttrState:                "State",
+	AttrClass:                "Class",
+	AttrVendorSpecific:       "Vendor-Specific",
+	AttrSessionTimeout:       "Session-Timeout",
+	AttrIdleTimeout:          "Idle-Timeout",
+	AttrTerminationAction:    "Termination-Action",
+	AttrCalledStationId:      "Called-Station-Id",
+	AttrCallingStationId:     "Calling-Station-Id",
+	AttrNASIdentifier:        "NAS-Identifier",
+	AttrProxyState:           "Proxy-State",
+	AttrAcctStatusType:       "Acct-Status-Type",
+	AttrAcctDelayTime:        "Acct-Delay-Time",
+	AttrAcctInputOctets:      "Acct-Input-Octets",
+	AttrAcctOutputOctets:     "Acct-Output-Octets",
+	AttrAcctSessionId:        "Acct-Session-Id",
+	AttrAcctAuthentic:        "Acct-Authentic",
+	AttrAcctSessionTime:      "Acct-Session-Time",
+	AttrAcctInputPackets:     "Acct-Input-Packets",
+	AttrAcctOutputPackets:    "Acct-Output-Packets",
+	AttrAcctTerminateCause:   "Acct-Terminate-Cause",
+	AttrAcctMultiSessionId:   "Acct-Multi-Session-Id",
+	AttrAcctInputGigawords:   "Acct-Input-Gigawords",
+	AttrAcctOutputGigawords:  "Acct-Output-Gigawords",
+	AttrEventTimestamp:       "Event-Timestamp",
+	AttrNASPortType:          "NAS-Port-Type",
+	AttrPrompt:               "Prompt",
+	AttrMessageAuthenticator: "Message-Authenticator",
+	AttrAcctInterimInterval:  "Acct-Interim-Interval",
+	AttrNASPortId:            "NAS-Port-Id",
+	AttrNASIPv6Address:       "NAS-IPv6-Address",
+	AttrFramedInterfaceId:    "Framed-Interface-Id",
+	AttrFramedIPv6Prefix:     "Framed-IPv6-Prefix",
+	AttrFramedIPv6Route:      "Framed-IPv6-Route",
+	AttrErrorCause:           "Error-Cause",
+	AttrFramedIPv6Address:    "Framed-IPv6-Address",
+}
+
+func (t AttributeType) String() string {
+	if name, ok := attributeNames[t]; ok {
+		return name
+	}
+	return "Attr-" + strconv.Itoa(int(t))
+}
+
+const (
+	packetHeaderLength         = 20
+	maxPacketLength            = 4096
+	maxAttributeLength         = 253
+	maxPasswordLength          = 128
+	authenticatorLength        = 16
+	messageAuthenticatorOffset = 2
+)
+
+var (
+	ErrPacketMalformed             = errors.New("malformed radius packet")
+	ErrPacketTooLarge              = errors.New("radius packet too large")
+	ErrAttributeTooLarge           = errors.New("radius attribute too large")
+	ErrPasswordTooLarge            = errors.New("radius password too large")
+	ErrInvalidAuthenticator        = errors.New("invalid radius authenticator")
+	ErrInvalidMessageAuthenticator = errors.New("invalid radius message-authenticator")
+	ErrMissingMessageAuthenticator = errors.New("missing radius message-authenticator")
+)
+
+type Attribute struct {
+	Type  AttributeType
+	Value []byte
+}
+
+type Packet struct {
+	Code          PacketCode
+	Identifier    byte
+	Authenticator [authenticatorLength]byte
+	Attributes    []Attribute
+}
+
+// NewPacket creates a packet with a random identifier and, for Access-Request,
+// a random Request Authenticator
+func NewPacket(code PacketCode) (*Packet, error) {
+	packet := &Packet{Code: code}
+
+	var identifier [1]byte
+	if _, err := rand.Read(identifier[:]); err != nil {
+		return nil, err
+	}
+	packet.Identifier = identifier[0]
+
+	if code == CodeAccessRequest {
+		if _, err := rand.Read(packet.Authenticator[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return packet, nil
+}
+
+func (p *Packet) Add(attributeType AttributeType, value []byte) {
+	p.Attributes = append(p.Attributes, Attribute{Type: attributeType, Value: value})
+}
+
+func (p *Packet) AddString(attributeType AttributeType, value string) {
+	p.Add(attributeType, []byte(value))
+}
+
+func (p *Packet) AddInteger(attributeType AttributeType, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	p.Add(attributeType, b)
+}
+
+func (p *Packet) AddIPAddress(attributeType AttributeType, ip net.IP) error {
+	ipv4 := ip.To4()
+	if ipv4 == nil {
+		return errors.New("invalid IPv4 address " + ip.String())
+	}
+	p.Add(attributeType, []byte(ipv4))
+	return nil
+}
+
+func (p *Packet) AddIPv6Address(attributeType AttributeType, ip net.IP) error {
+	if ip == nil || ip.To4() != nil {
+		return errors.New("invalid IPv6 address " + ip.String())
+	}
+	p.Add(attributeType, []byte(ip.To16()))
+	return nil
+}
+
+// AddIPv6Prefix adds the prefix as reserved byte, prefix length and the
+// significant bytes of the prefix (RFC 3162 section 2.3)
+func (p *Packet) AddIPv6Prefix(attributeType AttributeType, prefix *net.IPNet) error {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || prefix.IP.To4() != nil {
+		return errors.New("invalid IPv6 prefix " + prefix.String())
+	}
+	value := append([]byte{0, byte(ones)}, prefix.IP.Mask(prefix.Mask)[:(ones+7)/8]...)
+	p.Add(attributeType, value)
+	return nil
+}
+
+// AddMessageAuthenticator adds a zeroed Message-Authenticator (RFC 3579) which
+// is filled in when the packet is encoded
+func (p *Packet) AddMessageAuthenticator() {
+	p.Del(AttrMessageAuthenticator)
+	p.Add(AttrMessageAuthenticator, make([]byte, authenticatorLength))
+}
+
+// AddPassword adds a User-Password in clear text. It is hidden with the shared
+// secret and the Request Authenticator (RFC 2865 section 5.2) when the packet
+// is encoded, so the same packet can be sent to servers with different secrets
+func (p *Packet) AddPassword(password string) error {
+	if len(password) > maxPasswordLength {
+		return ErrPasswordTooLarge
+	}
+	p.AddString(AttrUserPassword, password)
+	return nil
+}
+
+func (p *Packet) Del(attributeType AttributeType) {
+	attributes := p.Attributes[:0]
+	for _, attribute := range p.Attributes {
+		if attribute.Type != attributeType {
+			attributes = append(attributes, attribute)
+		}
+	}
+	p.Attributes = attributes
+}
+
+func (p *Packet) Get(attributeType AttributeType) ([]byte, bool) {
+	for _, attribute := range p.Attributes {
+		if attribute.Type == attributeType {
+			return attribute.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *Packet) GetAll(attributeType AttributeType) [][]byte {
+	var values [][]byte
+	for _, attribute := range p.Attributes {
+		if attribute.Type == attributeType {
+			values = append(values, attribute.Value)
+		}
+	}
+	return values
+}
+
+func (p *Packet) GetString(attributeType AttributeType) (string, bool) {
+	value, ok := p.Get(attributeType)
+	return string(value), ok
+}
+
+func (p *Packet) GetInteger(attributeType AttributeType) (uint32, bool) {
+	value, ok := p.Get(attributeType)
+	if !ok || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+func (p *Packet) GetIPAddress(attributeType AttributeType) (net.IP, bool) {
+	value, ok := p.Get(attributeType)
+	if !ok || len(value) != net.IPv4len {
+		return nil, false
+	}
+	return net.IP(value), true
+}
+
+func (p *Packet) GetIPv6Address(attributeType AttributeType) (net.IP, bool) {
+	value, ok := p.Get(attributeType)
+	if !ok || len(value) != net.IPv6len {
+		return nil, false
+	}
+	return net.IP(value), true
+}
+
+// GetIPv6Prefix reads a prefix added by AddIPv6Prefix. Bits beyond the prefix
+// length are cleared
+func (p *Packet) GetIPv6Prefix(attributeType AttributeType) (*net.IPNet, bool) {
+	value, ok := p.Get(attributeType)
+	if !ok || len(value) < 2 || len(value) > 2+net.IPv6len {
+		return nil, false
+	}
+
+	ones := int(value[1])
+	if ones > 8*net.IPv6len || ones > 8*(len(value)-2) {
+		return nil, false
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, value[2:])
+	mask := net.CIDRMask(ones, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+}
+
+// Encode serializes the packet. Message-Authenticator is computed when present
+// and, for Accounting-Request, the Request Authenticator is derived from the
+// packet contents as described in RFC 2866 section 3
+func (p *Packet) Encode(secret string) ([]byte, error) {
+	b, err := p.marshal([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Code {
+	case CodeAccessRequest:
+		signMessageAuthenticator(b, []byte(secret))
+	default:
+		// The Request Authenticator is computed over a zeroed authenticator field
+		copy(b[4:packetHeaderLength], make([]byte, authenticatorLength))
+		signMessageAuthenticator(b, []byte(secret))
+		authenticator := packetAuthenticator(b, []byte(secret))
+		copy(b[4:packetHeaderLength], authenticator)
+		copy(p.Authenticator[:], authenticator)
+	}
+
+	return b, nil
+}
+
+// EncodeResponse serializes a reply to request, such as a Disconnect-ACK. The
+// Message-Authenticator is computed over the Request Authenticator and the
+// Response Authenticator is derived as in RFC 2865 section 3
+func (p *Packet) EncodeResponse(request *Packet, secret string) ([]byte, error) {
+	p.Identifier = request.Identifier
+	p.Authenticator = request.Authenticator
+
+	b, err := p.marshal([]byte(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	signMessageAuthenticator(b, []byte(secret))
+	authenticator := packetAuthenticator(b, []byte(secret))
+	copy(b[4:packetHeaderLength], authenticator)
+	copy(p.Authenticator[:], authenticator)
+
+	return b, nil
+}
+
+func (p *Packet) marshal(secret []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.Write([]byte{byte(p.Code), p.Identifier, 0, 0})
+	buffer.Write(p.Authenticator[:])
+
+	for _, attribute := range p.Attributes {
+		value := attribute.Value
+		if attribute.Type == AttrUserPassword && p.Code == CodeAccessRequest {
+			hidden, err := hidePassword(value, secret, p.Authenticator[:])
+			if err != nil {
+				return nil, err
+			}
+			value = hidden
+		}
+
+		if len(value) > maxAttributeLength {
+			return nil, ErrAttributeTooLarge
+		}
+		buffer.WriteByte(byte(attribute.Type))
+		buffer.WriteByte(byte(len(value) + 2))
+		buffer.Write(value)
+	}
+
+	if buffer.Len() > maxPacketLength {
+		return nil, ErrPacketTooLarge
+	}
+
+	b := buffer.Bytes()
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+// DecodePacket parses a raw packet without verifying its authenticators
+func DecodePacket(b []byte) (*Packet, error) {
+	if len(b) < packetHeaderLength {
+		return nil, ErrPacketMalformed
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < packetHeaderLength || length > maxPacketLength || length > len(b) {
+		return nil, ErrPacketMalformed
+	}
+
+	packet := &Packet{
+		Code:       PacketCode(b[0]),
+		Identifier: b[1],
+	}
+	copy(packet.Authenticator[:], b[4:packetHeaderLength])
+
+	attributes := b[packetHeaderLength:length]
+	for len(attributes) > 0 {
+		if len(attributes) < 2 {
+			return nil, ErrPacketMalformed
+		}
+		attributeLength := int(attributes[1])
+		if attributeLength < 2 || attributeLength > len(attributes) {
+			return nil, ErrPacketMalformed
+		}
+		value := make([]byte, attributeLength-2)
+		copy(value, attributes[2:attributeLength])
+		packet.Add(AttributeType(attributes[0]), value)
+		attributes = attributes[attributeLength:]
+	}
+
+	return packet, nil
+}
+
+// VerifyResponse checks the Response Authenticator and, when present, the
+// Message-Authenticator of a raw reply against the request it answers
+func VerifyResponse(response []byte, request *Packet, secret string) error {
+	if len(response) < packetHeaderLength {
+		return ErrPacketMalformed
+	}
+
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if length < packetHeaderLength || length > len(response) {
+		return ErrPacketMalformed
+	}
+
+	b := make([]byte, length)
+	copy(b, response[:length])
+
+	received := make([]byte, authenticatorLength)
+	copy(received, b[4:packetHeaderLength])
+	copy(b[4:packetHeaderLength], request.Authenticator[:])
+
+	if !hmac.Equal(received, packetAuthenticator(b, []byte(secret))) {
+		return ErrInvalidAuthenticator
+	}
+
+	return verifyMessageAuthenticator(b, []byte(secret))
+}
+
+// VerifyRequest checks the Request Authenticator of a raw Accounting-Request,
+// Disconnect-Request or CoA-Request (RFC 2866, RFC 5176) and, when present,
+// its Message-Authenticator, both computed over a zeroed authenticator field
+func VerifyRequest(request []byte, secret string) error {
+	if len(request) < packetHeaderLength {
+		return ErrPacketMalformed
+	}
+
+	length := int(binary.BigEndian.Uint16(request[2:4]))
+	if length < packetHeaderLength || length > len(request) {
+		return ErrPacketMalformed
+	}
+
+	b := make([]byte, length)
+	copy(b, request[:length])
+
+	received := make([]byte, authenticatorLength)
+	copy(received, b[4:packetHeaderLength])
+	copy(b[4:packetHeaderLength], make([]byte, authenticatorLength))
+
+	if !hmac.Equal(received, packetAuthenticator(b, []byte(secret))) {
+		return ErrInvalidAuthenticator
+	}
+
+	return verifyMessageAuthenticator(b, []byte(secret))
+}
+
+func packetAuthenticator(b []byte, secret []byte) []byte {
+	hash := md5.New()
+	hash.Write(b)
+	hash.Write(secret)
+	return hash.Sum(nil)
+}
+
+// messageAuthenticatorValue returns the value slice of the Message-Authenticator
+// attribute inside an encoded packet, or nil when the packet carries none
+func messageAuthenticatorValue(b []byte) []byte {
+	attributes := b[packetHeaderLength:]
+	offset := packetHeaderLength
+	for len(attributes) >= 2 {
+		attributeLength := int(attributes[1])
+		if attributeLength < 2 || attributeLength > len(attributes) {
+			return nil
+		}
+		if AttributeType(attributes[0]) == AttrMessageAuthenticator && attributeLength == authenticatorLength+messageAuthenticatorOffset {
+			return b[offset+messageAuthenticatorOffset : offset+attributeLength]
+		}
+		attributes = attributes[attributeLength:]
+		offset += attributeLength
+	}
+	return nil
+}
+
+func signMessageAuthenticator(b []byte, secret []byte) {
+	value := messageAuthenticatorValue(b)
+	if value == nil {
+		return
+	}
+	copy(value, make([]byte, authenticatorLength))
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	copy(value, mac.Sum(nil))
+}
+
+func verifyMessageAuthenticator(b []byte, secret []byte) error {
+	value := messageAuthenticatorValue(b)
+	if value == nil {
+		return nil
+	}
+	received := make([]byte, authenticatorLength)
+	copy(received, value)
+	copy(value, make([]byte, authenticatorLength))
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	expected := mac.Sum(nil)
+	copy(value, received)
+
+	if !hmac.Equal(received, expected) {
+		return ErrInvalidMessageAuthenticator
+	}
+	return nil
+}
+
+func hidePassword(password []byte, secret []byte, authenticator []byte) ([]byte, error) {
+	if len(password) > maxPasswordLength {
+		return nil, ErrPasswordTooLarge
+	}
+
+	length := (len(password) + 15) / 16 * 16
+	if length == 0 {
+		length = 16
+	}
+
+	hidden := make([]byte, length)
+	copy(hidden, password)
+
+	previous := authenticator
+	for i := 0; i < length; i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		block := hash.Sum(nil)
+		for j := 0; j < 16; j++ {
+			hidden[i+j] ^= block[j]
+		}
+		previous = hidden[i : i+16]
+	}
+
+	return hidden, nil
+}
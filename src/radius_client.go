@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRadiusTimeout = 3 * time.Second
+	defaultRadiusRetries = 3
+	defaultRadiusBackoff = 1.0
+)
+
+var ErrNoResponse = errors.New("no response from radius server")
+
+type RadiusClient struct {
+	Server  string
+	Secret  string
+	Timeout time.Duration
+	Retries int
+	Backoff float64
+
+	// AllowMissingMessageAuthenticator accepts replies to Access-Requests
+	// without Message-Authenticator, which BlastRADIUS (CVE-2024-3596) forges
+	AllowMissingMessageAuthenticator bool
+}
+
+func NewRadiusClient(server ConfigServer) *RadiusClient {
+	client := &RadiusClient{
+		Server:  server.Server,
+		Secret:  server.Secret,
+		Timeout: defaultRadiusTimeout,
+		Retries: defaultRadiusRetries,
+		Backoff: defaultRadiusBackoff,
+
+		AllowMissingMessageAuthenticator: server.AllowMissingMessageAuthenticator,
+	}
+
+	if server.Timeout > 0 {
+		client.Timeout = time.Duration(server.Timeout * float64(time.Second))
+	}
+	if server.Retries != nil && *server.Retries >= 0 {
+		client.Retries = *server.Retries
+	}
+	if server.Backoff >= 1 {
+		client.Backoff = server.Backoff
+	}
+
+	return client
+}
+
+// Exchange sends the request and waits for a reply carrying the same
+// identifier and a valid Response Authenticator, and for an Access-Request a
+// valid Message-Authenticator. Replies that fail verification are discarded
+// silently as required by RFC 2865.
+// Retransmissions resend the same bytes, keeping the identifier and
+// authenticator as RFC 5080 section 2.2.1 requires, and the wait grows by
+// Backoff after each one. No attempt outlives the context deadline
+func (c *RadiusClient) Exchange(ctx context.Context, request *Packet) (*Packet, error) {
+	payload, err := request.Encode(c.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("udp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buffer := make([]byte, maxPacketLength)
+	timeout := c.Timeout
+
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.Write(payload); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			if n < packetHeaderLength || buffer[1] != request.Identifier {
+				log.Warnf("radiusClient: discarded unexpected packet from %s", c.Server)
+				continue
+			}
+
+			if err := VerifyResponse(buffer[:n], request, c.Secret); err != nil {
+				log.Warnf("radiusClient: discarded packet from %s: %s", c.Server, err)
+				continue
+			}
+
+			response, err := DecodePacket(buffer[:n])
+			if err != nil {
+				log.Warnf("radiusClient: discarded packet from %s: %s", c.Server, err)
+				continue
+			}
+
+			if _, ok := response.Get(AttrMessageAuthenticator); !ok && request.Code == CodeAccessRequest && !c.AllowMissingMessageAuthenticator {
+				log.Warnf("radiusClient: discarded packet from %s: %s", c.Server, ErrMissingMessageAuthenticator)
+				continue
+			}
+
+			return response, nil
+		}
+
+		log.Warnf("radiusClient: timeout waiting for %s from %s (attempt %d)", request.Code, c.Server, attempt+1)
+		if c.Backoff > 1 {
+			timeout = time.Duration(float64(timeout) * c.Backoff)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrNoResponse
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	purposeAuthentication = "authentication"
+	purposeAccounting     = "accounting"
+
+	strategyFailover   = "failover"
+	strategyRoundRobin = "round-robin"
+	strategyWeighted   = "weighted"
+
+	defaultDeadAfter = 3
+	defaultHoldDown  = 60
+
+	// OpenVPN drops clients that are not authenticated within hand-window,
+	// 60 seconds by default, so a request must give up well before that
+	defaultRadiusDeadline = 30 * time.Second
+)
+
+var ErrNoServers = errors.New("no radius server configured")
+
+// RadiusServerGroup sends requests to the servers of one purpose, failing over
+// on timeouts. Server health is kept in the database so that short-lived
+// plugin invocations share it
+type RadiusServerGroup struct {
+	purpose    string
+	group      ConfigServerGroup
+	repository *SQLiteRepository
+}
+
+func authenticationServers(repository *SQLiteRepository) *RadiusServerGroup {
+	return &RadiusServerGroup{purpose: purposeAuthentication, group: config.Radius.Authentication, repository: repository}
+}
+
+func accountingServers(repository *SQLiteRepository) *RadiusServerGroup {
+	return &RadiusServerGroup{purpose: purposeAccounting, group: config.Radius.Accounting, repository: repository}
+}
+
+// servers returns the configured servers, the legacy single server first
+func (g ConfigServerGroup) servers() []ConfigServer {
+	var servers []ConfigServer
+	if len(g.Server) > 0 {
+		servers = append(servers, g.ConfigServer)
+	}
+	return append(servers, g.Servers...)
+}
+
+// Exchange tries the servers in the order given by the group strategy until
+// one answers or the Radius.Deadline runs out
+func (g *RadiusServerGroup) Exchange(request *Packet) (*Packet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), radiusDeadline())
+	defer cancel()
+
+	servers := g.group.servers()
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	// Encoding errors do not depend on the server, report them before trying any
+	if _, err := request.Encode(servers[0].Secret); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+
+	states, err := g.repository.ServerStates(g.purpose)
+	if err != nil {
+		log.Warnf("radiusServerGroup: unable to read %s server state %s", g.purpose, err.Error())
+		states = map[string]ServerState{}
+	}
+
+	lastErr := ErrNoResponse
+
+	for _, server := range g.order(servers, states, now) {
+		if g.group.Strategy == strategyRoundRobin {
+			if err := g.repository.MarkServerUsed(g.purpose, server.Server, now); err != nil {
+				log.Warnf("radiusServerGroup: unable to record use of %s: %s", server.Server, err.Error())
+			}
+		}
+
+		log.Info("radiusServerGroup: sending " + request.Code.String() + " to " + server.Server)
+
+		response, err := NewRadiusClient(server).Exchange(ctx, request)
+		if err == nil {
+			if state, ok := states[server.Server]; ok && (state.Failures > 0 || state.DeadUntil > 0) {
+				if err := g.repository.RecordServerSuccess(g.purpose, server.Server); err != nil {
+					log.Warnf("radiusServerGroup: unable to record success of %s: %s", server.Server, err.Error())
+				}
+			}
+			return response, nil
+		}
+
+		if ctx.Err() != nil {
+			log.Warnf("radiusServerGroup: deadline of %s exceeded waiting for %s", radiusDeadline(), server.Server)
+			return nil, ErrNoResponse
+		}
+
+		log.Warnf("radiusServerGroup: %s server %s failed: %s", g.purpose, server.Server, err.Error())
+		lastErr = err
+
+		dead, err := g.repository.RecordServerFailure(g.purpose, server.Server, g.deadAfter(), time.Now().Unix()+int64(g.holdDown()))
+		if err != nil {
+			log.Warnf("radiusServerGroup: unable to record failure of %s: %s", server.Server, err.Error())
+		} else if dead {
+			log.Warnf("radiusServerGroup: %s server %s marked dead for %d seconds", g.purpose, server.Server, g.holdDown())
+		}
+	}
+
+	return nil, lastErr
+}
+
+// order returns the servers to try. Dead servers are left out while their
+// hold-down lasts, unless every server is dead, in which case they are tried
+// in the order they come back
+func (g *RadiusServerGroup) order(servers []ConfigServer, states map[string]ServerState, now int64) []ConfigServer {
+	var alive, dead []ConfigServer
+	for _, server := range servers {
+		if states[server.Server].DeadUntil > now {
+			dead = append(dead, server)
+		} else {
+			alive = append(alive, server)
+		}
+	}
+
+	if len(alive) == 0 {
+		sort.SliceStable(dead, func(i, j int) bool {
+			return states[dead[i].Server].DeadUntil < states[dead[j].Server].DeadUntil
+		})
+		return dead
+	}
+
+	switch g.group.Strategy {
+	case strategyRoundRobin:
+		sort.SliceStable(alive, func(i, j int) bool {
+			return states[alive[i].Server].LastUsed < states[alive[j].Server].LastUsed
+		})
+	case strategyWeighted:
+		alive = weightedOrder(alive)
+	}
+
+	return alive
+}
+
+// weightedOrder shuffles the servers so that the first one is picked with a
+// probability proportional to its weight, and so on for the rest
+func weightedOrder(servers []ConfigServer) []ConfigServer {
+	remaining := append([]ConfigServer(nil), servers...)
+	ordered := make([]ConfigServer, 0, len(servers))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, server := range remaining {
+			total += serverWeight(server)
+		}
+
+		pick := rand.Intn(total)
+		for i, server := range remaining {
+			pick -= serverWeight(server)
+			if pick < 0 {
+				ordered = append(ordered, server)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+func serverWeight(server ConfigServer) int {
+	if server.Weight <= 0 {
+		return 1
+	}
+	return server.Weight
+}
+
+func radiusDeadline() time.Duration {
+	if config.Radius.Deadline <= 0 {
+		return defaultRadiusDeadline
+	}
+	return time.Duration(config.Radius.Deadline * float64(time.Second))
+}
+
+func (g *RadiusServerGroup) deadAfter() int {
+	if g.group.DeadAfter <= 0 {
+		return defaultDeadAfter
+	}
+	return g.group.DeadAfter
+}
+
+func (g *RadiusServerGroup) holdDown() int {
+	if g.group.HoldDown <= 0 {
+		return defaultHoldDown
+	}
+	return g.group.HoldDown
+}
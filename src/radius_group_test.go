@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// closedUDPAddress returns an address nobody listens on, so that reads fail
+// with connection refused
+func closedUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	return address
+}
+
+func TestServerGroupFailover(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	secret := "s3cr3t"
+	live := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		return encodeTestResponse(t, &Packet{Code: CodeAccessAccept}, request, secret)
+	})
+	down := closedUDPAddress(t)
+
+	group := &RadiusServerGroup{
+		purpose: purposeAuthentication,
+		group: ConfigServerGroup{
+			DeadAfter: 1,
+			HoldDown:  300,
+			Servers:   []ConfigServer{{Server: down, Secret: secret}, {Server: live, Secret: secret}},
+		},
+		repository: repository,
+	}
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+
+	response, err := group.Exchange(request)
+	if err != nil {
+		t.Fatalf("Failover exchange failed: %v", err)
+	}
+	if response.Code != CodeAccessAccept {
+		t.Fatalf("Expected Access-Accept, got %s", response.Code)
+	}
+
+	states, err := repository.ServerStates(purposeAuthentication)
+	if err != nil {
+		t.Fatalf("Failed to read server states: %v", err)
+	}
+	if states[down].DeadUntil <= time.Now().Unix() {
+		t.Fatalf("Expected %s to be marked dead, got %+v", down, states[down])
+	}
+
+	ordered := group.order(group.group.servers(), states, time.Now().Unix())
+	if len(ordered) != 1 || ordered[0].Server != live {
+		t.Fatalf("Dead server must be out of rotation, got %+v", ordered)
+	}
+
+	// Once the hold-down is over the server is tried again
+	ordered = group.order(group.group.servers(), states, time.Now().Unix()+301)
+	if len(ordered) != 2 || ordered[0].Server != down {
+		t.Fatalf("Server must come back after hold-down, got %+v", ordered)
+	}
+}
+
+func TestServerGroupOrder(t *testing.T) {
+	servers := []ConfigServer{{Server: "a:1812"}, {Server: "b:1812"}, {Server: "c:1812"}}
+	states := map[string]ServerState{
+		"a:1812": {LastUsed: 30},
+		"b:1812": {LastUsed: 10},
+		"c:1812": {LastUsed: 20, DeadUntil: 100},
+	}
+
+	group := &RadiusServerGroup{group: ConfigServerGroup{Strategy: strategyRoundRobin}}
+	ordered := group.order(servers, states, 50)
+	if len(ordered) != 2 || ordered[0].Server != "b:1812" || ordered[1].Server != "a:1812" {
+		t.Fatalf("Round-robin must prefer the least recently used live server, got %+v", ordered)
+	}
+
+	group.group.Strategy = strategyFailover
+	ordered = group.order(servers, map[string]ServerState{}, 50)
+	if ordered[0].Server != "a:1812" || ordered[2].Server != "c:1812" {
+		t.Fatalf("Failover must keep the configured order, got %+v", ordered)
+	}
+
+	weighted := []ConfigServer{{Server: "heavy", Weight: 9}, {Server: "light", Weight: 1}}
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		if weightedOrder(weighted)[0].Server == "heavy" {
+			heavyFirst++
+		}
+	}
+	if heavyFirst < 800 || heavyFirst > 980 {
+		t.Fatalf("Weighted order picked the heavy server first %d times out of 1000", heavyFirst)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// revealPassword reverses the RFC 2865 User-Password hiding as a server would
+func revealPassword(hidden []byte, secret []byte, authenticator []byte) string {
+	password := make([]byte, len(hidden))
+	previous := authenticator
+	for i := 0; i < len(hidden); i += 16 {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		block := hash.Sum(nil)
+		for j := 0; j < 16; j++ {
+			password[i+j] = hidden[i+j] ^ block[j]
+		}
+		previous = hidden[i : i+16]
+	}
+
+	for len(password) > 0 && password[len(password)-1] == 0 {
+		password = password[:len(password)-1]
+	}
+	return string(password)
+}
+
+// encodeTestResponse signs a reply the way a RADIUS server does
+func encodeTestResponse(t *testing.T, response *Packet, request *Packet, secret string) []byte {
+	response.Identifier = request.Identifier
+	response.Authenticator = request.Authenticator
+	// Servers sign their replies to Access-Requests
+	if _, ok := response.Get(AttrMessageAuthenticator); !ok && request.Code == CodeAccessRequest {
+		response.AddMessageAuthenticator()
+	}
+
+	b, err := response.marshal([]byte(secret))
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %v", err)
+	}
+	signMessageAuthenticator(b, []byte(secret))
+	copy(b[4:packetHeaderLength], packetAuthenticator(b, []byte(secret)))
+	return b
+}
+
+// startTestServer answers every request with the packet built by reply
+func startTestServer(t *testing.T, reply func(request *Packet, raw []byte) []byte) string {
+	return startTestServerOn(t, "127.0.0.1:0", reply)
+}
+
+// startTestServerOn is startTestServer listening on the given address
+func startTestServerOn(t *testing.T, address string, reply func(request *Packet, raw []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("Unable to listen on %s: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, maxPacketLength)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			raw := make([]byte, n)
+			copy(raw, buffer[:n])
+			request, err := DecodePacket(raw)
+			if err != nil {
+				continue
+			}
+			if response := reply(request, raw); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestPasswordHiding(t *testing.T) {
+	secret := []byte("s3cr3t")
+	authenticator := []byte("0123456789abcdef")
+
+	for _, password := range []string{"a", "exactly16bytes!!", "a,password,with='quotes'", "0123456789abcdef0123"} {
+		hidden, err := hidePassword([]byte(password), secret, authenticator)
+		if err != nil {
+			t.Fatalf("Failed to hide password: %v", err)
+		}
+		if len(hidden)%16 != 0 {
+			t.Fatalf("Hidden password length %d is not a multiple of 16", len(hidden))
+		}
+		if got := revealPassword(hidden, secret, authenticator); got != password {
+			t.Fatalf("Password round trip failed: got %q, want %q", got, password)
+		}
+	}
+
+	if _, err := hidePassword(make([]byte, maxPasswordLength+1), secret, authenticator); err != ErrPasswordTooLarge {
+		t.Fatalf("Expected ErrPasswordTooLarge, got: %v", err)
+	}
+}
+
+func TestPacketEncodeDecode(t *testing.T) {
+	request, err := NewPacket(CodeAccessRequest)
+	if err != nil {
+		t.Fatalf("Failed to create packet: %v", err)
+	}
+
+	request.AddString(AttrUserName, "user,Class=injected")
+	request.AddInteger(AttrServiceType, 5)
+	request.AddIPAddress(AttrNASIPAddress, net.ParseIP("10.10.10.123"))
+	request.AddMessageAuthenticator()
+
+	b, err := request.Encode("s3cr3t")
+	if err != nil {
+		t.Fatalf("Failed to encode packet: %v", err)
+	}
+
+	decoded, err := DecodePacket(b)
+	if err != nil {
+		t.Fatalf("Failed to decode packet: %v", err)
+	}
+
+	if name, _ := decoded.GetString(AttrUserName); name != "user,Class=injected" {
+		t.Fatalf("User-Name mismatch: got %q", name)
+	}
+	if _, ok := decoded.Get(AttrClass); ok {
+		t.Fatalf("User-Name content must not produce extra attributes")
+	}
+	if serviceType, _ := decoded.GetInteger(AttrServiceType); serviceType != 5 {
+		t.Fatalf("Service-Type mismatch: got %d", serviceType)
+	}
+	if ip, _ := decoded.GetIPAddress(AttrNASIPAddress); !ip.Equal(net.ParseIP("10.10.10.123")) {
+		t.Fatalf("NAS-IP-Address mismatch: got %s", ip)
+	}
+	if err := verifyMessageAuthenticator(b, []byte("s3cr3t")); err != nil {
+		t.Fatalf("Message-Authenticator verification failed: %v", err)
+	}
+	if err := verifyMessageAuthenticator(b, []byte("wrong")); err != ErrInvalidMessageAuthenticator {
+		t.Fatalf("Expected ErrInvalidMessageAuthenticator, got: %v", err)
+	}
+
+	if _, err := DecodePacket(b[:packetHeaderLength-1]); err != ErrPacketMalformed {
+		t.Fatalf("Expected ErrPacketMalformed, got: %v", err)
+	}
+}
+
+func TestRadiusClientExchange(t *testing.T) {
+	secret := "s3cr3t"
+
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		if err := verifyMessageAuthenticator(raw, []byte(secret)); err != nil {
+			return nil
+		}
+		hidden, _ := request.Get(AttrUserPassword)
+		response := &Packet{Code: CodeAccessReject}
+		if revealPassword(hidden, []byte(secret), request.Authenticator[:]) == "p4ssw0rd" {
+			response.Code = CodeAccessAccept
+			response.AddString(AttrClass, "premium")
+		}
+		response.AddMessageAuthenticator()
+		return encodeTestResponse(t, response, request, secret)
+	})
+
+	client := &RadiusClient{Server: server, Secret: secret, Timeout: time.Second, Retries: 1}
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+	request.AddPassword("p4ssw0rd")
+	request.AddMessageAuthenticator()
+
+	response, err := client.Exchange(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if response.Code != CodeAccessAccept {
+		t.Fatalf("Expected Access-Accept, got %s", response.Code)
+	}
+	if class, _ := response.GetString(AttrClass); class != "premium" {
+		t.Fatalf("Class mismatch: got %q", class)
+	}
+
+	request, _ = NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+	request.AddPassword("wrong")
+	request.AddMessageAuthenticator()
+
+	response, err = client.Exchange(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if response.Code != CodeAccessReject {
+		t.Fatalf("Expected Access-Reject, got %s", response.Code)
+	}
+}
+
+func TestRadiusClientMissingMessageAuthenticator(t *testing.T) {
+	secret := "s3cr3t"
+
+	// An Access-Accept without Message-Authenticator, as forged by BlastRADIUS
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		response := &Packet{Code: CodeAccessAccept, Identifier: request.Identifier, Authenticator: request.Authenticator}
+		b, err := response.marshal([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to marshal response: %v", err)
+		}
+		copy(b[4:packetHeaderLength], packetAuthenticator(b, []byte(secret)))
+		return b
+	})
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+	request.AddPassword("p4ssw0rd")
+	request.AddMessageAuthenticator()
+
+	client := &RadiusClient{Server: server, Secret: secret, Timeout: 100 * time.Millisecond, Retries: 0}
+	if _, err := client.Exchange(context.Background(), request); err != ErrNoResponse {
+		t.Fatalf("Expected the reply to be discarded, got %v", err)
+	}
+
+	client.AllowMissingMessageAuthenticator = true
+	response, err := client.Exchange(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if response.Code != CodeAccessAccept {
+		t.Fatalf("Expected Access-Accept, got %s", response.Code)
+	}
+}
+
+func TestRadiusClientExchangeIPv6(t *testing.T) {
+	secret := "s3cr3t"
+
+	server := startTestServerOn(t, "[::1]:0", func(request *Packet, raw []byte) []byte {
+		return encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	})
+
+	client := &RadiusClient{Server: server, Secret: secret, Timeout: time.Second, Retries: 1}
+
+	request, _ := NewPacket(CodeAccountingRequest)
+	request.AddInteger(AttrAcctStatusType, AcctStatusTypeStart)
+
+	response, err := client.Exchange(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Exchange with %s failed: %v", server, err)
+	}
+	if response.Code != CodeAccountingResponse {
+		t.Fatalf("Expected Accounting-Response, got %s", response.Code)
+	}
+}
+
+func TestIPv6Attributes(t *testing.T) {
+	packet := &Packet{Code: CodeAccessAccept}
+	if err := packet.AddIPv6Address(AttrFramedIPv6Address, net.ParseIP("2001:db8::5")); err != nil {
+		t.Fatalf("Failed to add address: %v", err)
+	}
+	if err := packet.AddIPv6Address(AttrNASIPv6Address, net.ParseIP("192.0.2.1")); err == nil {
+		t.Fatalf("IPv4 addresses must be refused")
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:ab00::/40")
+	if err := packet.AddIPv6Prefix(AttrFramedIPv6Prefix, prefix); err != nil {
+		t.Fatalf("Failed to add prefix: %v", err)
+	}
+	if value, _ := packet.Get(AttrFramedIPv6Prefix); len(value) != 7 || value[1] != 40 {
+		t.Fatalf("Prefix must be encoded with its significant bytes, got %x", value)
+	}
+
+	raw, err := packet.marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal packet: %v", err)
+	}
+	decoded, err := DecodePacket(raw)
+	if err != nil {
+		t.Fatalf("Failed to decode packet: %v", err)
+	}
+
+	if ip, ok := decoded.GetIPv6Address(AttrFramedIPv6Address); !ok || ip.String() != "2001:db8::5" {
+		t.Fatalf("Unexpected Framed-IPv6-Address %v", ip)
+	}
+	if decodedPrefix, ok := decoded.GetIPv6Prefix(AttrFramedIPv6Prefix); !ok || decodedPrefix.String() != "2001:db8:ab00::/40" {
+		t.Fatalf("Unexpected Framed-IPv6-Prefix %v", decodedPrefix)
+	}
+
+	// The prefix length cannot exceed the prefix sent
+	truncated := &Packet{Code: CodeAccessAccept}
+	truncated.Add(AttrFramedIPv6Prefix, []byte{0, 64, 0x20, 0x01})
+	if _, ok := truncated.GetIPv6Prefix(AttrFramedIPv6Prefix); ok {
+		t.Fatalf("Truncated prefix must be refused")
+	}
+}
+
+func TestRadiusClientDiscardsSpoofedResponse(t *testing.T) {
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		return encodeTestResponse(t, &Packet{Code: CodeAccessAccept}, request, "not-the-secret")
+	})
+
+	client := &RadiusClient{Server: server, Secret: "s3cr3t", Timeout: 200 * time.Millisecond, Retries: 1}
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+	request.AddPassword("p4ssw0rd")
+
+	if _, err := client.Exchange(context.Background(), request); err != ErrNoResponse {
+		t.Fatalf("Expected ErrNoResponse for spoofed reply, got: %v", err)
+	}
+}
+
+func TestAccountingRequestAuthenticator(t *testing.T) {
+	secret := "s3cr3t"
+
+	request, _ := NewPacket(CodeAccountingRequest)
+	request.AddInteger(AttrAcctStatusType, AcctStatusTypeStop)
+	request.AddString(AttrAcctSessionId, "session")
+
+	b, err := request.Encode(secret)
+	if err != nil {
+		t.Fatalf("Failed to encode packet: %v", err)
+	}
+
+	// RFC 2866: MD5(Code + Identifier + Length + 16 zero octets + Attributes + Secret)
+	zeroed := make([]byte, len(b))
+	copy(zeroed, b)
+	copy(zeroed[4:packetHeaderLength], make([]byte, authenticatorLength))
+	expected := md5.Sum(append(zeroed, secret...))
+
+	if string(b[4:packetHeaderLength]) != string(expected[:]) {
+		t.Fatalf("Request Authenticator mismatch")
+	}
+
+	response := encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	if err := VerifyResponse(response, request, secret); err != nil {
+		t.Fatalf("Response verification failed: %v", err)
+	}
+	if err := VerifyResponse(response, request, "spoofed"); err != ErrInvalidAuthenticator {
+		t.Fatalf("Expected ErrInvalidAuthenticator, got: %v", err)
+	}
+}
+
+func TestRadiusClientRetransmission(t *testing.T) {
+	secret := "s3cr3t"
+
+	var mutex sync.Mutex
+	var received [][]byte
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, raw)
+		if len(received) < 2 {
+			return nil
+		}
+		return encodeTestResponse(t, &Packet{Code: CodeAccessAccept}, request, secret)
+	})
+
+	client := &RadiusClient{Server: server, Secret: secret, Timeout: 100 * time.Millisecond, Retries: 2, Backoff: 2}
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+	request.AddPassword("p4ssw0rd")
+	request.AddMessageAuthenticator()
+
+	if _, err := client.Exchange(context.Background(), request); err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected one retransmission, got %d requests", len(received))
+	}
+	if string(received[0]) != string(received[1]) {
+		t.Fatalf("Retransmission must reuse the identifier and authenticator")
+	}
+}
+
+func TestRadiusClientDeadline(t *testing.T) {
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		return nil
+	})
+
+	client := &RadiusClient{Server: server, Secret: "s3cr3t", Timeout: time.Second, Retries: 5}
+
+	request, _ := NewPacket(CodeAccessRequest)
+	request.AddString(AttrUserName, "testuser")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if _, err := client.Exchange(ctx, request); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Fatalf("Exchange outlived the deadline: %s", elapsed)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newSessionId returns a collision-resistant Acct-Session-Id made of the
+// session start time and 8 random bytes, e.g. 65A1F2C3-9F86D081884C7D65
+func newSessionId() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	timestamp := strings.ToUpper(strconv.FormatInt(time.Now().Unix(), 16))
+	return timestamp + "-" + strings.ToUpper(hex.EncodeToString(random)), nil
+}
+
+type sessionCounters struct {
+	InputOctets  uint64
+	OutputOctets uint64
+	SessionTime  uint32
+}
+
+// countersFromEnvironment reads the counters OpenVPN exports to
+// client-disconnect. bytes_received is traffic from the client, which is
+// the NAS input direction in RFC 2866 terms
+func countersFromEnvironment(env environment) sessionCounters {
+	var counters sessionCounters
+	counters.InputOctets, _ = strconv.ParseUint(env.Get("bytes_received"), 10, 64)
+	counters.OutputOctets, _ = strconv.ParseUint(env.Get("bytes_sent"), 10, 64)
+
+	sessionTime, _ := strconv.ParseUint(env.Get("time_duration"), 10, 32)
+	counters.SessionTime = uint32(sessionTime)
+
+	return counters
+}
+
+// addTo adds the octet counters, splitting them into the 32 bit value and the
+// Gigawords overflow (RFC 2869), and the session time. OpenVPN does not
+// export packet counts so Acct-Input-Packets and Acct-Output-Packets are omitted
+func (c sessionCounters) addTo(request *Packet) {
+	request.AddInteger(AttrAcctInputOctets, uint32(c.InputOctets))
+	request.AddInteger(AttrAcctOutputOctets, uint32(c.OutputOctets))
+
+	if gigawords := uint32(c.InputOctets >> 32); gigawords > 0 {
+		request.AddInteger(AttrAcctInputGigawords, gigawords)
+	}
+	if gigawords := uint32(c.OutputOctets >> 32); gigawords > 0 {
+		request.AddInteger(AttrAcctOutputGigawords, gigawords)
+	}
+
+	request.AddInteger(AttrAcctSessionTime, c.SessionTime)
+}
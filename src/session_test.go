@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCountersFromEnvironment(t *testing.T) {
+	env := parseEnvironment([]string{"bytes_received=5000000000", "bytes_sent=1234", "time_duration=3600", "password=a=b"})
+	if env.Get("password") != "a=b" {
+		t.Fatalf("Values must keep their '=' characters, got %q", env.Get("password"))
+	}
+
+	request, _ := NewPacket(CodeAccountingRequest)
+	countersFromEnvironment(env).addTo(request)
+
+	expected := map[AttributeType]uint32{
+		AttrAcctInputOctets:    uint32(5000000000 - 1<<32),
+		AttrAcctInputGigawords: 1,
+		AttrAcctOutputOctets:   1234,
+		AttrAcctSessionTime:    3600,
+	}
+	for attributeType, want := range expected {
+		if got, ok := request.GetInteger(attributeType); !ok || got != want {
+			t.Fatalf("%s mismatch: got %d, want %d", attributeType, got, want)
+		}
+	}
+
+	if _, ok := request.Get(AttrAcctOutputGigawords); ok {
+		t.Fatalf("Acct-Output-Gigawords must be omitted when the counter did not wrap")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusClient is a CLIENT_LIST entry of the OpenVPN status output
+type statusClient struct {
+	CommonName     string
+	RealAddress    string
+	VirtualAddress string
+	BytesReceived  uint64
+	BytesSent      uint64
+	ConnectedSince int64
+	LastRef        int64  // last tunnel packet routed to or from the client
+	ClientId       string // management client id (CID), status version 2 and 3 only
+}
+
+const (
+	statusVersion1Header        = "Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since"
+	statusVersion1RoutingHeader = "Virtual Address,Common Name,Real Address,Last Ref"
+)
+
+// readStatus loads the connected clients from the management interface when
+// configured, otherwise from the status file
+func readStatus() (map[string]statusClient, error) {
+	if len(config.OpenVPN.Management) > 0 {
+		management, release, err := openManagement()
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		return managementStatus(management)
+	}
+
+	if len(config.OpenVPN.StatusFile) > 0 {
+		file, err := os.Open(config.OpenVPN.StatusFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		var lines []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return parseStatus(lines), nil
+	}
+
+	return map[string]statusClient{}, nil
+}
+
+// managementStatus reads the connected clients through the management interface
+func managementStatus(management managementCommander) (map[string]statusClient, error) {
+	lines, err := management.Command("status 2")
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(lines), nil
+}
+
+// parseStatus parses status-version 1, 2 and 3 output into clients keyed by
+// real address, which matches the OVPNClient Id
+func parseStatus(lines []string) map[string]statusClient {
+	clients := make(map[string]statusClient)
+	lastRefs := make(map[string]int64)
+
+	var columns, routeColumns map[string]int
+	var version1, version1Routes bool
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+
+		separator := ","
+		if strings.Contains(line, "\t") {
+			separator = "\t"
+		}
+		fields := strings.Split(line, separator)
+
+		switch {
+		case line == statusVersion1Header:
+			columns = statusColumns(fields)
+			version1 = true
+			continue
+		case line == statusVersion1RoutingHeader:
+			routeColumns = statusColumns(fields)
+			version1Routes = true
+			continue
+		case (version1 || version1Routes) && (line == "ROUTING TABLE" || line == "GLOBAL STATS" || line == "END"):
+			version1 = false
+			version1Routes = false
+			continue
+		case len(fields) > 2 && fields[0] == "HEADER" && fields[1] == "CLIENT_LIST":
+			columns = statusColumns(fields[2:])
+			continue
+		case len(fields) > 2 && fields[0] == "HEADER" && fields[1] == "ROUTING_TABLE":
+			routeColumns = statusColumns(fields[2:])
+			continue
+		}
+
+		// A client has a route for each of its addresses and iroutes
+		if version1Routes || (len(fields) > 1 && fields[0] == "ROUTING_TABLE") {
+			values := fields
+			if !version1Routes {
+				values = fields[1:]
+			}
+
+			realAddress := statusValue(routeColumns, values, "Real Address")
+			if lastRef := statusTime(routeColumns, values, "Last Ref"); lastRef > lastRefs[realAddress] {
+				lastRefs[realAddress] = lastRef
+			}
+			continue
+		}
+
+		var values []string
+		if version1 {
+			values = fields
+		} else if len(fields) > 1 && fields[0] == "CLIENT_LIST" {
+			values = fields[1:]
+		} else {
+			continue
+		}
+
+		if columns == nil {
+			continue
+		}
+
+		client := statusClient{
+			CommonName:     statusValue(columns, values, "Common Name"),
+			RealAddress:    statusValue(columns, values, "Real Address"),
+			VirtualAddress: statusValue(columns, values, "Virtual Address"),
+			ConnectedSince: statusTime(columns, values, "Connected Since"),
+			ClientId:       statusValue(columns, values, "Client ID"),
+		}
+		client.BytesReceived, _ = strconv.ParseUint(statusValue(columns, values, "Bytes Received"), 10, 64)
+		client.BytesSent, _ = strconv.ParseUint(statusValue(columns, values, "Bytes Sent"), 10, 64)
+
+		if len(client.RealAddress) > 0 {
+			clients[client.RealAddress] = client
+		}
+	}
+
+	for realAddress, lastRef := range lastRefs {
+		if client, ok := clients[realAddress]; ok {
+			client.LastRef = lastRef
+			clients[realAddress] = client
+		}
+	}
+
+	return clients
+}
+
+func statusValue(columns map[string]int, values []string, name string) string {
+	if index, ok := columns[name]; ok && index < len(values) {
+		return values[index]
+	}
+	return ""
+}
+
+// statusTime reads a time column from its "(time_t)" variant when present,
+// otherwise from the local time string
+func statusTime(columns map[string]int, values []string, name string) int64 {
+	if unix, err := strconv.ParseInt(statusValue(columns, values, name+" (time_t)"), 10, 64); err == nil {
+		return unix
+	}
+	if local, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", statusValue(columns, values, name), time.Local); err == nil {
+		return local.Unix()
+	}
+	return 0
+}
+
+func statusColumns(names []string) map[string]int {
+	columns := make(map[string]int)
+	for index, name := range names {
+		columns[name] = index
+	}
+	return columns
+}
+
+// counters converts the status entry into accounting counters at time now
+func (c statusClient) counters(now int64) sessionCounters {
+	counters := sessionCounters{
+		InputOctets:  c.BytesReceived,
+		OutputOctets: c.BytesSent,
+	}
+	if c.ConnectedSince > 0 && now > c.ConnectedSince {
+		counters.SessionTime = uint32(now - c.ConnectedSince)
+	}
+	return counters
+}
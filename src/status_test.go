@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStatusVersion2(t *testing.T) {
+	status := `TITLE,OpenVPN 2.5.5 x86_64-pc-linux-gnu
+TIME,2023-06-01 10:00:00,1685613600
+HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher
+CLIENT_LIST,testuser,192.168.1.50:55606,172.17.1.6,,5000000000,1234,2023-06-01 09:00:00,1685610000,testuser,0,0,AES-256-GCM
+HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)
+ROUTING_TABLE,172.17.1.6,testuser,192.168.1.50:55606,2023-06-01 10:00:00,1685613600
+END`
+
+	clients := parseStatus(strings.Split(status, "\n"))
+
+	client, ok := clients["192.168.1.50:55606"]
+	if !ok {
+		t.Fatalf("Client not found in status: %+v", clients)
+	}
+	if client.CommonName != "testuser" || client.VirtualAddress != "172.17.1.6" || client.LastRef != 1685613600 || client.ClientId != "0" {
+		t.Fatalf("Unexpected client: %+v", client)
+	}
+
+	counters := client.counters(1685613600)
+	if counters.InputOctets != 5000000000 || counters.OutputOctets != 1234 || counters.SessionTime != 3600 {
+		t.Fatalf("Unexpected counters: %+v", counters)
+	}
+}
+
+func TestParseStatusVersion3(t *testing.T) {
+	status := "HEADER\tCLIENT_LIST\tCommon Name\tReal Address\tVirtual Address\tBytes Received\tBytes Sent\tConnected Since\tConnected Since (time_t)\n" +
+		"CLIENT_LIST\ttestuser\t192.168.1.50:55606\t172.17.1.6\t100\t200\tThu Jun  1 09:00:00 2023\t1685610000"
+
+	client, ok := parseStatus(strings.Split(status, "\n"))["192.168.1.50:55606"]
+	if !ok || client.BytesReceived != 100 || client.BytesSent != 200 || client.ConnectedSince != 1685610000 {
+		t.Fatalf("Unexpected client: %+v", client)
+	}
+}
+
+func TestParseStatusVersion1(t *testing.T) {
+	status := `OpenVPN CLIENT LIST
+Updated,Thu Jun  1 10:00:00 2023
+Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since
+testuser,192.168.1.50:55606,100,200,Thu Jun  1 09:00:00 2023
+ROUTING TABLE
+Virtual Address,Common Name,Real Address,Last Ref
+172.17.1.6,testuser,192.168.1.50:55606,Thu Jun  1 10:00:00 2023
+GLOBAL STATS
+END`
+
+	clients := parseStatus(strings.Split(status, "\n"))
+	if len(clients) != 1 {
+		t.Fatalf("Expected one client, got %+v", clients)
+	}
+
+	client := clients["192.168.1.50:55606"]
+	if client.BytesReceived != 100 || client.BytesSent != 200 || client.ConnectedSince == 0 || client.LastRef != client.ConnectedSince+3600 {
+		t.Fatalf("Unexpected client: %+v", client)
+	}
+}
+
+func TestInterimInterval(t *testing.T) {
+	defaultInterval := config.Radius.InterimInterval
+	defer func() { config.Radius.InterimInterval = defaultInterval }()
+
+	config.Radius.InterimInterval = 0
+	if interval := interimInterval(OVPNClient{}); interval != 0 {
+		t.Fatalf("Expected interim updates disabled, got %d", interval)
+	}
+
+	config.Radius.InterimInterval = 600
+	if interval := interimInterval(OVPNClient{}); interval != 600 {
+		t.Fatalf("Expected configured default, got %d", interval)
+	}
+	if interval := interimInterval(OVPNClient{InterimInterval: 300}); interval != 300 {
+		t.Fatalf("Expected Acct-Interim-Interval from Access-Accept, got %d", interval)
+	}
+	if interval := interimInterval(OVPNClient{InterimInterval: 10}); interval != minimumInterimInterval {
+		t.Fatalf("Expected minimum interval, got %d", interval)
+	}
+}
+
+func TestSendInterimUpdates(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	now := int64(1700000000)
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", SessionId: "65A1F2C3-0000000000000001", StartedAt: now - 600})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", SessionId: "65A1F2C3-0000000000000002", StartedAt: now - 600})
+
+	secret := "s3cr3t"
+	requests := make(chan *Packet, 2)
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		requests <- request
+		return encodeTestResponse(t, &Packet{Code: CodeAccountingResponse}, request, secret)
+	})
+
+	radius, openvpn := config.Radius, config.OpenVPN
+	defer func() { config.Radius, config.OpenVPN = radius, openvpn }()
+	config.Radius.Accounting = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret}}
+	config.Radius.Deadline = 1
+	config.Radius.InterimInterval = 300
+	config.OpenVPN = ConfigOpenVPN{Management: "/run/openvpn/management.sock"}
+
+	// bob is missing from the status
+	setSharedManagement(newTestManagement("192.0.2.10:50000"))
+	defer setSharedManagement(nil)
+
+	sendInterimUpdates(repository, now)
+
+	for i := 0; i < 2; i++ {
+		request := <-requests
+		sessionId, _ := request.GetString(AttrAcctSessionId)
+		octets, hasOctets := request.GetInteger(AttrAcctInputOctets)
+		sessionTime, _ := request.GetInteger(AttrAcctSessionTime)
+
+		switch sessionId {
+		case "65A1F2C3-0000000000000001":
+			if !hasOctets || octets != 1000 {
+				t.Fatalf("Expected the octets of the status, got %d", octets)
+			}
+		case "65A1F2C3-0000000000000002":
+			// Zero octets would reset the counters on the accounting server
+			if hasOctets || sessionTime != 600 {
+				t.Fatalf("Expected only the session time without status, got %+v", request.Attributes)
+			}
+		default:
+			t.Fatalf("Unexpected Interim-Update for %q", sessionId)
+		}
+	}
+}
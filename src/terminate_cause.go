@@ -0,0 +1,45 @@
+package main
+
+// signalTerminateCauses maps the "signal" OpenVPN reports for a closed client
+// instance to Acct-Terminate-Cause (RFC 2866 section 5.10)
+var signalTerminateCauses = map[string]uint32{
+	// The client sent explicit-exit-notify
+	"remote-exit": AcctTerminateCauseUserRequest,
+	// --inactive
+	"inactive": AcctTerminateCauseIdleTimeout,
+	// Keepalive pings stopped arriving
+	"ping-restart": AcctTerminateCauseLostCarrier,
+	"ping-exit":    AcctTerminateCauseLostCarrier,
+	// The TCP connection or the link failed
+	"connection-reset": AcctTerminateCausePortError,
+	"error":            AcctTerminateCausePortError,
+	// Shutdown and restart of the server. A management "kill" also ends the
+	// client with sigterm, ovpn-radius records Admin-Reset for the sessions it
+	// disconnects itself so they are told apart from a shutdown
+	"sigterm": AcctTerminateCauseAdminReboot,
+	"sigint":  AcctTerminateCauseAdminReboot,
+	"sighup":  AcctTerminateCauseAdminReboot,
+	"sigusr1": AcctTerminateCauseNASRequest,
+}
+
+// terminateCause returns the Acct-Terminate-Cause of the Stop of a session.
+// A cause recorded by ovpn-radius before it disconnected the session comes
+// first, then the "signal" OpenVPN passes to client-disconnect. A session that
+// was idle for its Idle-Timeout was disconnected by OpenVPN's "inactive",
+// which needs the activity recorded by enforceTimeouts to be told apart from
+// the client leaving
+func terminateCause(client *OVPNClient, env environment, now int64) uint32 {
+	if client.TerminateCause > 0 {
+		return client.TerminateCause
+	}
+
+	if cause, ok := signalTerminateCauses[env.Get("signal")]; ok {
+		return cause
+	}
+
+	if client.IdleTimeout > 0 && client.LastActivityAt > 0 && now-client.LastActivityAt >= int64(client.IdleTimeout) {
+		return AcctTerminateCauseIdleTimeout
+	}
+
+	return AcctTerminateCauseUserRequest
+}
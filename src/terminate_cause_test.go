@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTerminateCause(t *testing.T) {
+	now := int64(1700000000)
+	none := environment{}
+
+	if cause := terminateCause(&OVPNClient{StartedAt: now - 600}, none, now); cause != AcctTerminateCauseUserRequest {
+		t.Fatalf("Expected User-Request, got %d", cause)
+	}
+	if cause := terminateCause(&OVPNClient{IdleTimeout: 300, LastActivityAt: now - 300}, none, now); cause != AcctTerminateCauseIdleTimeout {
+		t.Fatalf("Expected Idle-Timeout, got %d", cause)
+	}
+	if cause := terminateCause(&OVPNClient{IdleTimeout: 300, LastActivityAt: now - 20}, none, now); cause != AcctTerminateCauseUserRequest {
+		t.Fatalf("Expected User-Request for an active session, got %d", cause)
+	}
+	// Without recorded activity idleness is unknown
+	if cause := terminateCause(&OVPNClient{IdleTimeout: 300, StartedAt: now - 600}, none, now); cause != AcctTerminateCauseUserRequest {
+		t.Fatalf("Expected User-Request without recorded activity, got %d", cause)
+	}
+
+	signals := map[string]uint32{
+		"remote-exit":      AcctTerminateCauseUserRequest,
+		"inactive":         AcctTerminateCauseIdleTimeout,
+		"ping-restart":     AcctTerminateCauseLostCarrier,
+		"connection-reset": AcctTerminateCausePortError,
+		"sigterm":          AcctTerminateCauseAdminReboot,
+		"sighup":           AcctTerminateCauseAdminReboot,
+		"unknown":          AcctTerminateCauseUserRequest,
+	}
+	for signal, expected := range signals {
+		if cause := terminateCause(&OVPNClient{}, environment{"signal": signal}, now); cause != expected {
+			t.Fatalf("Expected terminate cause %d for signal %s, got %d", expected, signal, cause)
+		}
+	}
+
+	// The cause recorded before a kill wins over the signal of the kill
+	recorded := &OVPNClient{TerminateCause: AcctTerminateCauseSessionTimeout}
+	if cause := terminateCause(recorded, environment{"signal": "sigterm"}, now); cause != AcctTerminateCauseSessionTimeout {
+		t.Fatalf("Expected Session-Timeout, got %d", cause)
+	}
+
+	// A Disconnect-Request is an Admin-Reset, a shutdown with the same signal is not
+	killed := &OVPNClient{TerminateCause: AcctTerminateCauseAdminReset}
+	if cause := terminateCause(killed, environment{"signal": "sigterm"}, now); cause != AcctTerminateCauseAdminReset {
+		t.Fatalf("Expected Admin-Reset, got %d", cause)
+	}
+}
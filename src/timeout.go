@@ -0,0 +1,242 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionTimeoutAfterStart converts a Session-Timeout received while the
+// session is running into seconds after StartedAt, so it counts from now
+func sessionTimeoutAfterStart(client *OVPNClient, timeout uint32, now int64) int {
+	if timeout > 0 && client.StartedAt > 0 && now > client.StartedAt {
+		return int(timeout) + int(now-client.StartedAt)
+	}
+	return int(timeout)
+}
+
+// enforceTimeouts records the tunnel activity of sessions with an
+// Idle-Timeout and disconnects the sessions whose Session-Timeout has run out,
+// or re-authorizes them when Termination-Action asks for it. OpenVPN itself
+// disconnects idle clients through the "inactive" directive of client-connect,
+// sessions idle for an Idle-Timeout changed later by CoA or re-authorization
+// are disconnected here
+func enforceTimeouts(repository *SQLiteRepository, now int64) {
+	clients, err := repository.All()
+	if err != nil {
+		log.Errorf("enforceTimeouts: unable to read sessions %s", err.Error())
+		return
+	}
+
+	var status map[string]statusClient
+	var expired, idle, rejected []OVPNClient
+
+	for _, client := range clients {
+		if client.StartedAt == 0 {
+			continue
+		}
+
+		if client.IdleTimeout > 0 {
+			if status == nil {
+				status, err = readStatus()
+				if err != nil {
+					log.Warnf("enforceTimeouts: unable to read OpenVPN status %s", err.Error())
+					status = map[string]statusClient{}
+				}
+			}
+
+			// Without a route in the status the activity is unknown and the session stays
+			if entry, ok := status[client.Id]; ok && entry.LastRef > 0 {
+				if entry.LastRef > client.LastActivityAt {
+					if err := repository.SetLastActivity(client.Id, entry.LastRef); err != nil {
+						log.Warnf("enforceTimeouts: unable to record activity of %s: %s", client.Id, err.Error())
+					}
+					client.LastActivityAt = entry.LastRef
+				}
+
+				lastActivity := client.LastActivityAt
+				if lastActivity < client.StartedAt {
+					lastActivity = client.StartedAt
+				}
+				if now-lastActivity >= int64(client.IdleTimeout) {
+					idle = append(idle, client)
+					continue
+				}
+			}
+		}
+
+		if client.SessionTimeout <= 0 || now < client.StartedAt+int64(client.SessionTimeout) {
+			continue
+		}
+
+		if client.TerminationAction != TerminationActionRADIUSRequest {
+			expired = append(expired, client)
+			continue
+		}
+
+		// Sessions stay up while RADIUS is unreachable and are retried on the next check
+		authorized, err := reauthorize(repository, &client, now)
+		if err != nil {
+			log.Errorf("enforceTimeouts: unable to re-authorize %s: %s", client.Id, err.Error())
+		} else if !authorized {
+			rejected = append(rejected, client)
+		}
+	}
+
+	if len(expired) > 0 {
+		killSessions(repository, expired, AcctTerminateCauseSessionTimeout)
+	}
+	if len(idle) > 0 {
+		killSessions(repository, idle, AcctTerminateCauseIdleTimeout)
+	}
+	if len(rejected) > 0 {
+		killSessions(repository, rejected, AcctTerminateCauseReauthenticationFailure)
+	}
+}
+
+// reauthorize sends an Authorize-Only Access-Request with the State and Class
+// of the session (RFC 2865 section 5.29, RFC 5080 section 2.1.1) and stores
+// the authorization of the Access-Accept. It reports false when RADIUS
+// refused the session
+func reauthorize(repository *SQLiteRepository, client *OVPNClient, now int64) (bool, error) {
+	// A session whose request cannot be built would never be re-authorized
+	request, err := newAuthorizeOnlyRequest(client)
+	if err != nil {
+		log.Errorf("reauthorize: unable to build request for %s: %s", client.Id, err.Error())
+		return false, nil
+	}
+
+	response, err := authenticationServers(repository).Exchange(request)
+	if err != nil {
+		return false, err
+	}
+
+	log.Info("reauthorize: received " + response.Code.String() + " for user '" + client.CommonName + "' with Id " + client.Id)
+
+	// A challenge cannot be answered without the user
+	if response.Code != CodeAccessAccept {
+		return false, nil
+	}
+
+	if class, ok := response.Get(AttrClass); ok {
+		client.ClassName = encodeHexAttribute(class)
+	}
+	if interval, ok := response.GetInteger(AttrAcctInterimInterval); ok {
+		client.InterimInterval = int(interval)
+	}
+
+	timeout, _ := response.GetInteger(AttrSessionTimeout)
+	client.SessionTimeout = sessionTimeoutAfterStart(client, timeout, now)
+	idleTimeout, _ := response.GetInteger(AttrIdleTimeout)
+	client.IdleTimeout = int(idleTimeout)
+	client.TerminationAction, _ = response.GetInteger(AttrTerminationAction)
+
+	client.StateName = ""
+	if state, ok := response.Get(AttrState); ok {
+		client.StateName = encodeHexAttribute(state)
+	}
+
+	if err := repository.SetAuthorization(*client); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// newAuthorizeOnlyRequest builds the re-authorization request of a session,
+// which carries no password. It has the attributes of the Access-Request of
+// the session, with Service-Type Authorize-Only
+func newAuthorizeOnlyRequest(client *OVPNClient) (*Packet, error) {
+	request, err := NewPacket(CodeAccessRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	request.AddString(AttrUserName, client.CommonName)
+	if err := addServerInfo(request); err != nil {
+		return nil, err
+	}
+
+	// Sessions stored before the attributes were kept get those that do not
+	// depend on the OpenVPN environment
+	attributes := client.AccessAttributes
+	if len(attributes) == 0 {
+		attributes, err = accessAttributes(environment{})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stored, err := DecodePacket(attributes)
+	if err != nil {
+		return nil, err
+	}
+	for _, attribute := range stored.Attributes {
+		if attribute.Type != AttrServiceType {
+			request.Attributes = append(request.Attributes, attribute)
+		}
+	}
+	request.AddInteger(AttrServiceType, ServiceTypeAuthorizeOnly)
+	addNASPort(request, client.NASPort)
+
+	if len(client.StateName) > 0 {
+		state, err := decodeHexAttribute(client.StateName)
+		if err != nil {
+			return nil, err
+		}
+		request.Add(AttrState, state)
+	}
+
+	if len(client.ClassName) > 0 {
+		class, err := decodeHexAttribute(client.ClassName)
+		if err != nil {
+			return nil, err
+		}
+		request.Add(AttrClass, class)
+	}
+
+	request.AddString(AttrAcctSessionId, client.SessionId)
+	request.AddMessageAuthenticator()
+
+	return request, nil
+}
+
+// killSessions disconnects the sessions through the management interface
+// after recording the cause their Stop will carry
+func killSessions(repository *SQLiteRepository, sessions []OVPNClient, cause uint32) {
+	if len(config.OpenVPN.Management) == 0 {
+		log.Errorf("killSessions: OpenVPN.Management is required to disconnect %d sessions", len(sessions))
+		return
+	}
+
+	management, release, err := openManagement()
+	if err != nil {
+		log.Errorf("killSessions: unable to connect to management interface %s", err.Error())
+		return
+	}
+	defer release()
+
+	clients, err := managementStatus(management)
+	if err != nil {
+		log.Errorf("killSessions: unable to read OpenVPN status %s", err.Error())
+		return
+	}
+
+	for _, session := range sessions {
+		if _, ok := clients[session.Id]; !ok {
+			log.Warnf("killSessions: user '%s' with Id %s is not connected to OpenVPN", session.CommonName, session.Id)
+			continue
+		}
+
+		if err := repository.SetTerminateCause(session.Id, cause); err != nil {
+			log.Errorf("killSessions: unable to record terminate cause of %s: %s", session.Id, err.Error())
+			continue
+		}
+
+		if err := clientKill(management, clients, session.Id); err != nil {
+			log.Errorf("killSessions: unable to disconnect %s: %s", session.Id, err.Error())
+			repository.SetTerminateCause(session.Id, 0)
+			continue
+		}
+
+		log.Infof("killSessions: disconnected user '%s' with Id %s, terminate cause %d", session.CommonName, session.Id, cause)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestEnforceTimeouts(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	now := int64(1700000000)
+	repository.Create(OVPNClient{Id: "2001:db8::10:50000", CommonName: "alice", StartedAt: now - 3600, SessionTimeout: 3600})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", StartedAt: now - 60, SessionTimeout: 3600})
+	repository.Create(OVPNClient{Id: "192.0.2.12:50000", CommonName: "carol", SessionTimeout: 1})
+
+	openvpn := config.OpenVPN
+	defer func() { config.OpenVPN = openvpn }()
+	config.OpenVPN = ConfigOpenVPN{Management: "/run/openvpn/management.sock"}
+
+	// IPv6 clients can only be killed by client id
+	management := newTestManagement("2001:db8::10:50000", "192.0.2.11:50000", "192.0.2.12:50000")
+	setSharedManagement(management)
+	defer setSharedManagement(nil)
+
+	enforceTimeouts(repository, now)
+
+	if len(management.commands) != 1 || management.commands[0] != "client-kill 1" {
+		t.Fatalf("Only the expired session must be killed, got %q", management.commands)
+	}
+
+	client, _ := repository.GetById("2001:db8::10:50000")
+	if cause := terminateCause(client, environment{}, now); cause != AcctTerminateCauseSessionTimeout {
+		t.Fatalf("Expected Session-Timeout terminate cause, got %d", cause)
+	}
+}
+
+// testManagement answers "status 2" with its status lines and records the
+// other commands
+type testManagement struct {
+	status   []string
+	commands []string
+}
+
+// newTestManagement lists the clients with the client ids 1, 2 and so on
+func newTestManagement(ids ...string) *testManagement {
+	m := &testManagement{status: []string{"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher"}}
+	for i, id := range ids {
+		m.status = append(m.status, "CLIENT_LIST,user,"+id+",,,1000,2000,2023-11-14 21:13:20,1699996400,user,"+strconv.Itoa(i+1)+","+strconv.Itoa(i+1)+",AES-256-GCM")
+	}
+	return m
+}
+
+func (m *testManagement) Command(command string) ([]string, error) {
+	if command == "status 2" {
+		return m.status, nil
+	}
+	m.commands = append(m.commands, command)
+	return []string{"SUCCESS: " + command}, nil
+}
+
+func TestEnforceIdleTimeout(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	now := int64(1700000000)
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", StartedAt: now - 3600, IdleTimeout: 600})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", StartedAt: now - 3600, IdleTimeout: 600})
+	// Not in the status, its activity is unknown
+	repository.Create(OVPNClient{Id: "192.0.2.12:50000", CommonName: "carol", StartedAt: now - 3600, IdleTimeout: 600})
+
+	openvpn := config.OpenVPN
+	defer func() { config.OpenVPN = openvpn }()
+	config.OpenVPN = ConfigOpenVPN{Management: "/run/openvpn/management.sock"}
+
+	management := newTestManagement("192.0.2.10:50000", "192.0.2.11:50000")
+	management.status = append(management.status,
+		"HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)",
+		"ROUTING_TABLE,10.8.0.6,alice,192.0.2.10:50000,2023-11-14 22:03:20,1699999000",
+		"ROUTING_TABLE,10.8.0.7,bob,192.0.2.11:50000,2023-11-14 22:13:00,1699999980",
+	)
+	setSharedManagement(management)
+	defer setSharedManagement(nil)
+
+	enforceTimeouts(repository, now)
+
+	if len(management.commands) != 1 || management.commands[0] != "client-kill 1" {
+		t.Fatalf("Only the idle session must be killed, got %q", management.commands)
+	}
+
+	alice, _ := repository.GetById("192.0.2.10:50000")
+	if cause := terminateCause(alice, environment{}, now); cause != AcctTerminateCauseIdleTimeout {
+		t.Fatalf("Expected Idle-Timeout terminate cause, got %d", cause)
+	}
+}
+
+func TestReauthorize(t *testing.T) {
+	repository, err := InitializeDatabase(true)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer repository.Close()
+
+	now := int64(1700000000)
+	state := encodeHexAttribute([]byte("reauth-state"))
+	// The re-authorization carries the attributes of the Access-Request
+	stored := &Packet{Code: CodeAccessRequest}
+	stored.AddInteger(AttrServiceType, 2)
+	stored.AddString(AttrCallingStationId, "192.0.2.10")
+	attributes, _ := stored.marshal(nil)
+
+	repository.Create(OVPNClient{Id: "192.0.2.10:50000", CommonName: "alice", StartedAt: now - 3600, SessionTimeout: 3600, TerminationAction: TerminationActionRADIUSRequest, StateName: state, AccessAttributes: attributes})
+	repository.Create(OVPNClient{Id: "192.0.2.11:50000", CommonName: "bob", StartedAt: now - 3600, SessionTimeout: 3600, TerminationAction: TerminationActionRADIUSRequest, AccessAttributes: attributes})
+	// Without stored attributes the configured NAS-Port-Type cannot be sent
+	repository.Create(OVPNClient{Id: "192.0.2.12:50000", CommonName: "carol", StartedAt: now - 3600, SessionTimeout: 3600, TerminationAction: TerminationActionRADIUSRequest, StateName: state})
+
+	secret := "s3cr3t"
+	server := startTestServer(t, func(request *Packet, raw []byte) []byte {
+		if serviceType, _ := request.GetInteger(AttrServiceType); serviceType != ServiceTypeAuthorizeOnly {
+			return nil
+		}
+		if _, ok := request.Get(AttrUserPassword); ok {
+			return nil
+		}
+		if station, _ := request.GetString(AttrCallingStationId); station != "192.0.2.10" || len(request.GetAll(AttrServiceType)) != 1 {
+			return nil
+		}
+		if requestState, _ := request.GetString(AttrState); requestState != "reauth-state" {
+			return encodeTestResponse(t, &Packet{Code: CodeAccessReject}, request, secret)
+		}
+		accept := &Packet{Code: CodeAccessAccept}
+		accept.AddInteger(AttrSessionTimeout, 1800)
+		return encodeTestResponse(t, accept, request, secret)
+	})
+
+	radius, openvpn, serverInfo := config.Radius, config.OpenVPN, config.ServerInfo
+	defer func() { config.Radius, config.OpenVPN, config.ServerInfo = radius, openvpn, serverInfo }()
+	config.Radius.Authentication = ConfigServerGroup{ConfigServer: ConfigServer{Server: server, Secret: secret}}
+	config.Radius.Deadline = 1
+	config.Radius.Attributes.AccessRequest = nil
+	config.ServerInfo.PortType = "Virtual"
+
+	config.OpenVPN = ConfigOpenVPN{Management: "/run/openvpn/management.sock"}
+
+	management := newTestManagement("192.0.2.10:50000", "192.0.2.11:50000", "192.0.2.12:50000")
+	setSharedManagement(management)
+	defer setSharedManagement(nil)
+
+	enforceTimeouts(repository, now)
+
+	// The rejected sessions are cut, the accepted one runs for another Session-Timeout
+	if len(management.commands) != 2 || management.commands[0] != "client-kill 2" || management.commands[1] != "client-kill 3" {
+		t.Fatalf("Only the rejected sessions must be killed, got %q", management.commands)
+	}
+
+	alice, _ := repository.GetById("192.0.2.10:50000")
+	if alice.SessionTimeout != 3600+1800 || alice.TerminationAction != TerminationActionDefault || len(alice.StateName) != 0 {
+		t.Fatalf("Unexpected authorization after Access-Accept: %+v", alice)
+	}
+
+	for _, id := range []string{"192.0.2.11:50000", "192.0.2.12:50000"} {
+		client, _ := repository.GetById(id)
+		if cause := terminateCause(client, environment{}, now); cause != AcctTerminateCauseReauthenticationFailure {
+			t.Fatalf("Expected Reauthentication-Failure terminate cause for %s, got %d", id, cause)
+		}
+	}
+}
+
+func TestSessionTimeoutAfterStart(t *testing.T) {
+	now := int64(1700000000)
+
+	if timeout := sessionTimeoutAfterStart(&OVPNClient{StartedAt: now - 600}, 300, now); timeout != 900 {
+		t.Fatalf("Expected Session-Timeout counting from now, got %d", timeout)
+	}
+	if timeout := sessionTimeoutAfterStart(&OVPNClient{}, 300, now); timeout != 300 {
+		t.Fatalf("Expected Session-Timeout of an unstarted session, got %d", timeout)
+	}
+}